@@ -1,23 +1,25 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"html"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
-
-	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/yaml.v3"
 )
 
@@ -26,54 +28,82 @@ const configPath = "./config.yaml"
 
 var templates = template.Must(template.ParseFiles("pages/index.html"))
 
-// Prepared statements as global variables
-var (
-	stmtWithUserAndSession *sql.Stmt
-	stmtWithUserOnly       *sql.Stmt
-	stmtGetUserSessions    *sql.Stmt
-	stmtInsertPoint        *sql.Stmt
-	stmtFetchGpsTrack      *sql.Stmt
-)
-
 // Struct Definitions
 type Point struct {
 	ID      int
-	Lat     string
-	Lon     string
-	Alt     string
-	Speed   string
-	Time    string
-	Bearing string
-	Hdop    string
+	Lat     float64
+	Lon     float64
+	Alt     float64
+	Speed   float64
+	Time    int64 // Unix milliseconds, 0 when the tracker sent no timestamp
+	Bearing float64
+	Hdop    float64
+	Acc     float64
 	User    string
 	Session string
 }
 
 // Declaration of struct needed for config.yaml
+
 type Cfg struct {
-	ServerPort              string `yaml:"ServerPort"`
-	ServerPortTLS           string `yaml:"ServerPortTLS"`
-	CertPathCrt             string `yaml:"CertPathCrt"`
-	CertPathKey             string `yaml:"CertPathKey"`
-	Key                     string `yaml:"Key"`
-	EnableTLS               bool   `yaml:"EnableTLS"`
-	DisableNoTLS            bool   `yaml:"DisableNoTLS"`
-	DefaultLat              string `yaml:"DefaultLat"`
-	DefaultLon              string `yaml:"DefaultLon"`
-	ShowOnlyLastPos         bool   `yaml:"ShowOnlyLastPos"`
-	MapRefreshTime          string `yaml:"MapRefreshTime"`
-	DefaultZoom             string `yaml:"DefaultZoom"`
-	ConsoleDebug            bool   `yaml:"ConsoleDebug"`
-	MaxGetParmLen           int    `yaml:"MaxGetParmLen"`
-	ShowPrecisonCircle      bool   `yaml:"ShowPrecisonCircle"`
-	MinZoom                 string `yaml:"MinZoom"`
-	MaxZoom                 string `yaml:"MaxZoom"`
-	ConvertTimestamp        bool   `yaml:"ConvertTimestamp"`
-	TimeZone                string `yaml:"TimeZone"`
-	MaxShowPoint            string `yaml:"MaxShowPoint"`
-	ShowMapOnlyWithUser     bool   `yaml:"ShowMapOnlyWithUser"`
-	AllowBypassMaxShowPoint bool   `yaml:"AllowBypassMaxShowPoint"`
-	EventRefreshTime        string `yaml:"EventRefreshTime"`
+	ServerPort              string             `yaml:"ServerPort"`
+	ServerPortTLS           string             `yaml:"ServerPortTLS"`
+	CertPathCrt             string             `yaml:"CertPathCrt"`
+	CertPathKey             string             `yaml:"CertPathKey"`
+	ACMEDomains             []string           `yaml:"ACMEDomains"`
+	ACMEEmail               string             `yaml:"ACMEEmail"`
+	ACMEDirectoryURL        string             `yaml:"ACMEDirectoryURL"`
+	ACMECAFile              string             `yaml:"ACMECAFile"`
+	ACMECacheDir            string             `yaml:"ACMECacheDir"`
+	Key                     string             `yaml:"Key"`
+	AdminKeyHash            string             `yaml:"AdminKeyHash"`
+	EnableTLS               bool               `yaml:"EnableTLS"`
+	DisableNoTLS            bool               `yaml:"DisableNoTLS"`
+	RedirectHTTP            bool               `yaml:"RedirectHTTP"`
+	MetricsAddr             string             `yaml:"MetricsAddr"`
+	MetricsToken            string             `yaml:"MetricsToken"`
+	DefaultLat              string             `yaml:"DefaultLat"`
+	DefaultLon              string             `yaml:"DefaultLon"`
+	ShowOnlyLastPos         bool               `yaml:"ShowOnlyLastPos"`
+	MapRefreshTime          string             `yaml:"MapRefreshTime"`
+	DefaultZoom             string             `yaml:"DefaultZoom"`
+	ConsoleDebug            bool               `yaml:"ConsoleDebug"`
+	LogLevel                string             `yaml:"LogLevel"`
+	LogFormat               string             `yaml:"LogFormat"`
+	MaxGetParmLen           int                `yaml:"MaxGetParmLen"`
+	LegacyAddPointErrors    bool               `yaml:"LegacyAddPointErrors"`
+	ShowPrecisonCircle      bool               `yaml:"ShowPrecisonCircle"`
+	MinZoom                 string             `yaml:"MinZoom"`
+	MaxZoom                 string             `yaml:"MaxZoom"`
+	ConvertTimestamp        bool               `yaml:"ConvertTimestamp"`
+	TimeZone                string             `yaml:"TimeZone"`
+	MaxShowPoint            string             `yaml:"MaxShowPoint"`
+	ShowMapOnlyWithUser     bool               `yaml:"ShowMapOnlyWithUser"`
+	AllowBypassMaxShowPoint bool               `yaml:"AllowBypassMaxShowPoint"`
+	EnforceShares           bool               `yaml:"EnforceShares"`
+	EventRefreshTime        string             `yaml:"EventRefreshTime"`
+	Database                string             `yaml:"Database"`
+	SQLitePath              string             `yaml:"SQLitePath"`
+	PostgresDSN             string             `yaml:"PostgresDSN"`
+	Webhooks                []Webhook          `yaml:"Webhooks"`
+	WebhookMaxAttempts      int                `yaml:"WebhookMaxAttempts"`
+	WebhookSessionTimeout   string             `yaml:"WebhookSessionTimeout"`
+	MQTTBroker              string             `yaml:"MQTTBroker"`
+	MQTTClientID            string             `yaml:"MQTTClientID"`
+	MQTTUsername            string             `yaml:"MQTTUsername"`
+	MQTTPassword            string             `yaml:"MQTTPassword"`
+	MQTTSubscriptions       []MQTTSubscription `yaml:"MQTTSubscriptions"`
+	MQTTRepublishPrefix     string             `yaml:"MQTTRepublishPrefix"`
+	MQTTDisableRepublish    bool               `yaml:"MQTTDisableRepublish"`
+	SessionSplitGap         string             `yaml:"SessionSplitGap"`
+	SessionSplitDistance    float64            `yaml:"SessionSplitDistance"`
+	AutoSessions            bool               `yaml:"AutoSessions"`
+	RetentionDays           int                `yaml:"RetentionDays"`
+	RetentionFullDays       int                `yaml:"RetentionFullDays"`
+	RetentionDownsample     string             `yaml:"RetentionDownsample"`
+	RetentionUsers          []RetentionPolicy  `yaml:"RetentionUsers"`
+	RetentionInterval       string             `yaml:"RetentionInterval"`
+	RetentionVacuum         bool               `yaml:"RetentionVacuum"`
 }
 
 var AppConfig Cfg
@@ -90,12 +120,37 @@ type LatLng struct {
 	Time    string `json:"time"`
 	Bear    string `json:"bear"`
 	Hdop    string `json:"hdop"`
+	Acc     string `json:"acc"`
+	Color   string `json:"color"`
+	// Unix milliseconds, Time holds the same value formatted for display
+	Timestamp int64 `json:"timestamp"`
+}
+
+// userPalette holds the colors used to tell users apart on the map.
+var userPalette = []string{"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4", "#f032e6", "#9a6324", "#800000", "#000075"}
+
+// userColor returns a stable color for a user.
+func userColor(user string) string {
+	n, err := strconv.ParseUint(user, 10, 64)
+	if err != nil {
+		for _, c := range user {
+			n += uint64(c)
+		}
+	}
+	return userPalette[n%uint64(len(userPalette))]
+}
+
+// UserTrack is the history of a single user passed to the template.
+type UserTrack struct {
+	User          string
+	Color         string
+	Latlonhistory []string
 }
 
 // Declaration of struct needed for the template
 type Page struct {
 	Lastpos            string
-	Latlonhistory      []string
+	Tracks             []UserTrack
 	DefaultLat         string
 	DefaultLon         string
 	ShowOnlyLastPos    bool
@@ -104,6 +159,8 @@ type Page struct {
 	MinZoom            string
 	MaxZoom            string
 	ShowPrecisonCircle bool
+	Geofences          string // JSON array of the geofences drawn on the map
+	Replay             bool   // replay of a recorded session, without live updates
 }
 
 type GPX struct {
@@ -126,119 +183,178 @@ type GPXPoint struct {
 	Latitude  float64 `xml:"lat,attr"`
 	Longitude float64 `xml:"lon,attr"`
 	Elevation float64 `xml:"ele"`
-	Time      string  `xml:"time"`
+	Time      string  `xml:"time,omitempty"`
+	// GPX 1.0 stores speed and course in the point itself, GPX 1.1 in the extensions
+	Course     float64        `xml:"course,omitempty"`
+	Speed      float64        `xml:"speed,omitempty"`
+	Hdop       float64        `xml:"hdop,omitempty"`
+	Extensions *GPXExtensions `xml:"extensions,omitempty"`
+}
+
+// GPXExtensions holds the speed and course written by common GPX 1.1 producers,
+// either directly or in a Garmin TrackPointExtension.
+type GPXExtensions struct {
+	Speed               float64              `xml:"speed,omitempty"`
+	Course              float64              `xml:"course,omitempty"`
+	TrackPointExtension *TrackPointExtension `xml:"TrackPointExtension,omitempty"`
+}
+
+type TrackPointExtension struct {
+	Speed  float64 `xml:"speed,omitempty"`
+	Course float64 `xml:"course,omitempty"`
 }
 
 // Main function
 func main() {
 	// Load the application configuration
 	ReadConfig()
+	if err := setupLogging(AppConfig); err != nil {
+		slog.Error("Invalid logging configuration", "error", err)
+		os.Exit(1)
+	}
+	if err := loadSessionSplit(AppConfig); err != nil {
+		slog.Error("Invalid session split configuration", "error", err)
+		os.Exit(1)
+	}
 
-	// Check if the database exists and create it if it doesn't
-	if _, err := os.Stat("./sqlite-database.db"); os.IsNotExist(err) {
-		CreateDB()
+	// Open the configured storage backend, creating the schema or bringing
+	// databases created by older versions up to date
+	var err error
+	store, err = OpenStore()
+	if err != nil {
+		slog.Error("Cannot open the database", "error", err)
+		os.Exit(1)
+	}
+
+	// Run a maintenance command instead of the server when one is given
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1:])
+		store.Close()
+		if err != nil {
+			slog.Error("Command failed", "command", os.Args[1], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := checkAdminKeyHash(AppConfig); err != nil {
+		slog.Error("Invalid admin key configuration", "error", err)
+		os.Exit(1)
 	}
 
-	// Open a database connection
-	db, err := sql.Open("sqlite3", "sqlite-database.db")
+	// Deliver the events of the configured webhooks in the background
+	webhooks, err = newWebhookDispatcher(AppConfig, &http.Client{Timeout: 10 * time.Second})
 	if err != nil {
-		checkErr(err)
+		slog.Error("Invalid webhook configuration", "error", err)
+		os.Exit(1)
+	}
+	if webhooks.enabled() {
+		go webhooks.run()
 	}
-	defer db.Close() // Ensure the database connection is closed when the main function exits
 
-	// Ping the database to ensure it's ready to accept connections
-	if err = db.Ping(); err != nil {
-		checkErr(err)
+	// Receive and republish points over MQTT when a broker is configured
+	mqttClient, err = newMQTTBridge(AppConfig)
+	if err != nil {
+		slog.Error("Invalid MQTT configuration", "error", err)
+		os.Exit(1)
 	}
 
-	// Initialize prepared statements
-	if err = InitDB(db); err != nil {
-		checkErr(err)
+	// Delete and downsample the old points in the background
+	retention, err = newRetentionJob(AppConfig)
+	if err != nil {
+		slog.Error("Invalid retention configuration", "error", err)
+		os.Exit(1)
+	}
+	if retention.enabled() {
+		go retention.run()
 	}
-	defer CloseDB() // Ensure the prepared statements are closed when the main function exits
 
 	// Setup HTTP server and routes
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/addpoint", func(w http.ResponseWriter, r *http.Request) { getAddPoint(w, r, db) })
-	mux.HandleFunc("/resetpoint", func(w http.ResponseWriter, r *http.Request) { getResetPoint(w, r, db) })
-	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) { getResetPointUsrSession(w, r, db) })
-	mux.HandleFunc("/download-gpx", func(w http.ResponseWriter, r *http.Request) { getGpxTrack(w, r, db) })
+	mux.HandleFunc("/addpoint", getAddPoint)
+	mux.HandleFunc("/owntracks", owntracksHandler)
+	mux.HandleFunc("/api/points/batch", postPointsBatch)
+	mux.HandleFunc("/resetpoint", getResetPoint)
+	mux.HandleFunc("/reset", getResetPointUsrSession)
+	mux.HandleFunc("/download-gpx", getGpxTrack)
+	mux.HandleFunc("/download-kml", getKmlTrack)
+	mux.HandleFunc("/download-kmz", getKmlTrack)
+	mux.HandleFunc("/upload-gpx", postGpxImport)
 	mux.HandleFunc("/getusersession", func(w http.ResponseWriter, r *http.Request) { getUserSessions(w, r) })
+	mux.HandleFunc("GET /api/devices", getDevices)
+	mux.HandleFunc("POST /api/devices", postDevice)
+	mux.HandleFunc("DELETE /api/devices/{id}", deleteDevice)
+	mux.HandleFunc("GET /api/shares", getShares)
+	mux.HandleFunc("POST /api/shares", postShare)
+	mux.HandleFunc("DELETE /api/shares/{id}", deleteShare)
+	mux.HandleFunc("GET /api/geofences", getGeofences)
+	mux.HandleFunc("POST /api/geofences", postGeofence)
+	mux.HandleFunc("GET /api/geofences/events", getGeofenceEvents)
+	mux.HandleFunc("PUT /api/geofences/{id}", putGeofence)
+	mux.HandleFunc("DELETE /api/geofences/{id}", deleteGeofence)
+	mux.HandleFunc("GET /api/sessions/{user}/{session}/stats", getSessionStats)
+	mux.HandleFunc("GET /api/replay", getReplay)
+	mux.HandleFunc("GET /api/profile", getProfile)
 	staticHandler := http.StripPrefix("/static/", http.FileServer(http.Dir("static")))
 	mux.Handle("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "max-age=604800")
 		staticHandler.ServeHTTP(w, r)
 	}))
+	mux.HandleFunc("/api/geojson/track", getGeoJSONTrack)
+	mux.HandleFunc("/api/geojson/last", getGeoJSONLast)
 	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) { eventsHandler(w, r) })
 	mux.HandleFunc("/favicon.ico", faviconHandler)
-	mux.Handle("/", gziphandler.GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { IndexHandler(w, r, db) })))
-
-	if !AppConfig.DisableNoTLS {
-		http.ListenAndServe(":"+AppConfig.ServerPort, mux)
+	mux.Handle("/", gziphandler.GzipHandler(http.HandlerFunc(IndexHandler)))
+	// Without their own listener, the metrics need their token
+	if AppConfig.MetricsAddr == "" && AppConfig.MetricsToken != "" {
+		mux.Handle("GET /metrics", metricsHandler())
 	}
-	if AppConfig.EnableTLS {
-		err := http.ListenAndServeTLS(":"+AppConfig.ServerPortTLS, AppConfig.CertPathCrt, AppConfig.CertPathKey, mux)
-		if err != nil {
-			fmt.Println(err)
-		}
-	}
-}
 
-// Initialize prepared statements
-func InitDB(db *sql.DB) error {
-	// Initialize the prepared statement when your application starts
-	var err error
-	stmtWithUserAndSession, err = db.Prepare("SELECT LAT, LON, ALT, SPEED, TIME, BEARING, HDOP, USER, SESSION FROM Points WHERE USER = ? AND SESSION = ? ORDER BY ID DESC LIMIT 1")
-	if err != nil {
-		return err
-	}
-	stmtWithUserOnly, err = db.Prepare("SELECT LAT, LON, ALT, SPEED, TIME, BEARING, HDOP, USER, SESSION FROM Points WHERE USER = ? ORDER BY ID DESC LIMIT 1")
-	if err != nil {
-		stmtWithUserAndSession.Close() // Close the previously prepared statement if the second fails
-		return err
+	// Serve until SIGINT or SIGTERM, then let the requests in progress finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := serve(ctx, withRequestID(instrumentRoutes(mux)))
+	if serveErr != nil {
+		slog.Error("Server error", "error", serveErr)
 	}
-	stmtGetUserSessions, err = db.Prepare("SELECT DISTINCT SESSION FROM Points WHERE USER = ?")
-	if err != nil {
-		return err
-	}
-	stmtInsertPoint, err = db.Prepare("INSERT INTO Points(LAT, LON, ALT, SPEED, TIME, BEARING, HDOP, USER, SESSION) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		return err
+
+	// Stop the background work before closing the prepared statements
+	mqttClient.stop()
+	webhooks.stop()
+	retention.stop()
+	if err := store.Close(); err != nil {
+		slog.Error("Cannot close the database", "error", err)
 	}
-	stmtFetchGpsTrack, err = db.Prepare("SELECT LAT, LON, ALT, TIME FROM Points WHERE user = ? AND session = ?")
-	if err != nil {
-		return err
+	if serveErr != nil {
+		os.Exit(1)
 	}
-	return nil
-}
-
-// Close prepared statements
-func CloseDB() {
-	stmtWithUserAndSession.Close()
-	stmtWithUserOnly.Close()
-	stmtGetUserSessions.Close()
-	stmtInsertPoint.Close()
-	stmtFetchGpsTrack.Close()
 }
 
 func faviconHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "./static/favicon.ico")
 }
 
-func IndexHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
 	// Push assets if client supports it
-	pushAssets(w)
+	pushAssets(w, r)
 	// Get query parameters
 	user := r.URL.Query().Get("user")
 	session := r.URL.Query().Get("session")
 	maxshowpoint := r.URL.Query().Get("maxshowpoint")
 
-	if AppConfig.ShowMapOnlyWithUser && user == "" { //show only if user is provided
+	// A share link replaces the user and session parameters
+	share, err := requestShare(r)
+	if err != nil {
+		writeShareError(w, r, err)
+		return
+	}
+
+	if share == nil && AppConfig.ShowMapOnlyWithUser && user == "" { //show only if user is provided
 		http.NotFound(w, r)
 		return
 	}
@@ -247,11 +363,39 @@ func IndexHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	points := fetchPointsFromDB(db, user, session, maxshowpoint)
-	latlonhistoryfromDB := buildLatLonHistory(points)
+	replay := r.URL.Query().Get("replay") == "1"
+
+	var points []Point
+	switch {
+	case replay:
+		// The replay loads its points from /api/replay
+	case share == nil:
+		points, err = fetchPointsFromDB(PointQuery{User: user, Session: session}, maxshowpoint)
+	case !share.LiveOnly:
+		points, err = fetchPointsFromDB(share.pointQuery(), maxshowpoint)
+	}
+	if err != nil {
+		requestLogger(r).Error("Error querying database", "error", err)
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+
+	// The public and the shared maps do not show geofences
+	fences := []Geofence{}
+	var fenceUsers []string
+	if user != "" {
+		fenceUsers = []string{user}
+	}
+	if share == nil && mayViewGeofences(r, fenceUsers) {
+		if fences, err = geofencesForUser(user); err != nil {
+			requestLogger(r).Error("Geofence query error", "error", err)
+			fences = []Geofence{}
+		}
+	}
+	fencesJSON, _ := json.Marshal(fences)
 
 	p := &Page{
-		Latlonhistory:      latlonhistoryfromDB,
+		Tracks:             buildUserTracks(points),
 		DefaultLat:         AppConfig.DefaultLat,
 		DefaultLon:         AppConfig.DefaultLon,
 		ShowOnlyLastPos:    AppConfig.ShowOnlyLastPos,
@@ -260,6 +404,8 @@ func IndexHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		MinZoom:            AppConfig.MinZoom,
 		MaxZoom:            AppConfig.MaxZoom,
 		ShowPrecisonCircle: AppConfig.ShowPrecisonCircle,
+		Geofences:          string(fencesJSON),
+		Replay:             replay,
 	}
 
 	renderTemplate(w, "index", p)
@@ -269,7 +415,7 @@ func isValidParam(param string, maxLen int) bool {
 	return checkParam(param, maxLen) && isSafeString(param)
 }
 
-func pushAssets(w http.ResponseWriter) {
+func pushAssets(w http.ResponseWriter, r *http.Request) {
 	if pusher, ok := w.(http.Pusher); ok {
 		assets := []string{
 			"/static/leaflet.css",
@@ -280,144 +426,104 @@ func pushAssets(w http.ResponseWriter) {
 		}
 		for _, asset := range assets {
 			if err := pusher.Push(asset, nil); err != nil {
-				fmt.Println("Failed to push: ", err)
+				requestLogger(r).Warn("Failed to push", "asset", asset, "error", err)
 			}
 		}
 	}
 }
 
-func fetchPointsFromDB(db *sql.DB, user, session, maxShowPoint string) []Point {
-	var limit string
+// fetchPointsFromDB returns the points of the map, limited to MaxShowPoint
+// or, when AllowBypassMaxShowPoint is set, to the maxshowpoint parameter.
+func fetchPointsFromDB(q PointQuery, maxShowPoint string) ([]Point, error) {
+	q.Limit, _ = strconv.Atoi(AppConfig.MaxShowPoint)
 	if AppConfig.AllowBypassMaxShowPoint && maxShowPoint != "" {
-		limit = " LIMIT ?"
-	} else if AppConfig.MaxShowPoint != "0" {
-		limit = " LIMIT ?"
+		q.Limit, _ = strconv.Atoi(maxShowPoint)
 	}
+	return store.FetchPoints(q)
+}
 
-	var whereClause strings.Builder
-	var args []interface{}
-	if user != "" {
-		whereClause.WriteString(" WHERE user=?")
-		args = append(args, user)
-		if session != "" {
-			whereClause.WriteString(" AND session=?")
-			args = append(args, session)
-		}
-	}
-
-	query := fmt.Sprintf(`
-                SELECT lat, lon, alt, speed, time, bearing, hdop
-                FROM Points %s
-                ORDER BY time DESC
-                %s`, whereClause.String(), limit)
-
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		checkErr(err)
-	}
-	defer stmt.Close()
-
-	if limit != "" {
-		if maxShowPoint != "" {
-			args = append(args, maxShowPoint)
-		} else {
-			args = append(args, AppConfig.MaxShowPoint)
-		}
-	}
+func buildLatLonHistory(points []Point) []string {
+	// Pre-allocate the slice to avoid reallocation
+	result := make([]string, 0, len(points))
 
-	rows, err := stmt.Query(args...)
-	if err != nil {
-		checkErr(err)
+	// Use strings.Builder for efficient string concatenation
+	for _, point := range points {
+		var builder strings.Builder
+		builder.WriteString(formatFloat(point.Lat))
+		builder.WriteByte(',')
+		builder.WriteString(formatFloat(point.Lon))
+		result = append(result, builder.String())
 	}
-	defer rows.Close()
 
-	points := make([]Point, 0)
+	return result
+}
 
-	for rows.Next() {
-		var point Point
-		if err := rows.Scan(&point.Lat, &point.Lon, &point.Alt, &point.Speed, &point.Time, &point.Bearing, &point.Hdop); err != nil {
-			checkErr(err)
+// buildUserTracks groups the points by user, keeping the order of first appearance.
+func buildUserTracks(points []Point) []UserTrack {
+	byUser := make(map[string][]Point)
+	var order []string
+	for _, point := range points {
+		if _, ok := byUser[point.User]; !ok {
+			order = append(order, point.User)
 		}
-		points = append(points, point)
+		byUser[point.User] = append(byUser[point.User], point)
 	}
 
-	if err := rows.Err(); err != nil {
-		checkErr(err)
+	tracks := make([]UserTrack, 0, len(order))
+	for _, user := range order {
+		tracks = append(tracks, UserTrack{
+			User:          user,
+			Color:         userColor(user),
+			Latlonhistory: buildLatLonHistory(byUser[user]),
+		})
 	}
-
-	// Invert the points if maxShowPoint is specified
-	if limit != "" {
-		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
-			points[i], points[j] = points[j], points[i]
-		}
-	}
-
-	return points
-}
-
-func buildLatLonHistory(points []Point) []string {
-    // Pre-allocate the slice to avoid reallocation
-    result := make([]string, 0, len(points)) 
-
-    // Use strings.Builder for efficient string concatenation
-    for _, point := range points {
-        var builder strings.Builder
-        builder.WriteString(point.Lat)
-        builder.WriteByte(',')
-        builder.WriteString(point.Lon)
-        result = append(result, builder.String())
-    }
-
-    return result
+	return tracks
 }
 
 func checkParam(param string, maxLen int) bool {
 	if param != "" {
 		if !isNumeric(param) {
-			fmt.Printf("%s not numeric\n", sanitize(param))
+			slog.Debug("Parameter not numeric", "value", param)
 			return false
 		} else if len(param) > maxLen {
-			fmt.Printf("%s too big\n", sanitize(param))
+			slog.Debug("Parameter too long", "value", param)
 			return false
 		}
 	}
 	return true
 }
 
-func getResetPoint(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	key := r.URL.Query().Get("key")
-	if key != AppConfig.Key {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+func getResetPoint(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
 		return
 	}
 
-	_, err := db.Exec("delete from Points")
-	if err != nil {
-		checkErr(err)
+	if err := store.DeleteAll(); err != nil {
+		requestLogger(r).Error("Reset error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
 	}
+	sessionStats.reset()
+	liveSessions.forget("")
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
-func getResetPointUsrSession(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func getResetPointUsrSession(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
 	user := r.URL.Query().Get("user")
 	session := r.URL.Query().Get("session")
-	key := r.URL.Query().Get("key")
 
-	if key != AppConfig.Key {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	if err := store.DeleteSession(user, session); err != nil {
+		requestLogger(r).Error("Reset error", "user", user, "session", session, "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
 		return
 	}
-
-	stmt, err := db.Prepare("delete from Points where USER=? and SESSION=?")
-	if err != nil {
-		checkErr(err)
-	}
-	_, err = stmt.Exec(user, session)
-	if err != nil {
-		checkErr(err)
-	}
+	sessionStats.invalidate(user, session)
+	liveSessions.forget(user)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
@@ -425,42 +531,25 @@ func getResetPointUsrSession(w http.ResponseWriter, r *http.Request, db *sql.DB)
 
 // getUserSessions retrieves user sessions and writes them as links in the response.
 func getUserSessions(w http.ResponseWriter, r *http.Request) {
-	// Authenticate the request.
-	key := r.URL.Query().Get("key")
-	if key != AppConfig.Key {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Authenticate the request, a device token only sees its own user.
+	user, err := authorizeUser(requestKey(r), r.URL.Query().Get("user"))
+	if err != nil {
+		writeAuthError(w, r, err)
 		return
 	}
 
 	// Validate the 'user' parameter.
-	user := r.URL.Query().Get("user")
 	if !checkParam(user, AppConfig.MaxGetParmLen) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
 	// Query the database for sessions associated with the user.
-	rows, err := stmtGetUserSessions.Query(user)
+	sessions, err := store.Sessions(user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var sessions []string
-	for rows.Next() {
-		var session string
-		if err := rows.Scan(&session); err != nil {
-			checkErr(err)
-			return
-		}
-		sessions = append(sessions, session)
-	}
-
-	if err := rows.Err(); err != nil {
-		checkErr(err)
-		return
-	}
 
 	// Set the response header and write the session links.
 	w.Header().Set("Content-Type", "text/html")
@@ -471,166 +560,444 @@ func getUserSessions(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getAddPoint(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	lat := r.URL.Query().Get("lat")
-	lon := r.URL.Query().Get("lon")
-	timestamp := r.URL.Query().Get("timestamp")
-	altitude := r.URL.Query().Get("altitude")
-	speed := r.URL.Query().Get("speed")
-	bearing := r.URL.Query().Get("bearing")
-	hdop := r.URL.Query().Get("hdop")
-	user := r.URL.Query().Get("user")
-	session := r.URL.Query().Get("session")
-	key := r.URL.Query().Get("key")
+func getAddPoint(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	params, err := readPointParams(w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		refusePoint(w, logger, params, status, err)
+		return
+	}
+
+	// A device token can only add points for its own user, which is also
+	// used when the request has no user parameter
+	if token, ok := bearerToken(r); ok {
+		params.Key = token
+	}
+	user, err := authorizeUser(params.Key, params.User)
+	if err != nil {
+		refusePoint(w, logger, params, authErrorStatus(err), err)
+		return
+	}
+	params.User = user
+
+	logger.Debug("Point received", params.logAttrs()...)
+
+	point, err := validatePoint(params)
+	if err != nil {
+		logRejectedPoint(logger, params, "", err)
+		writeAddPointError(w, pointErrorStatus(err), err)
+		return
+	}
+
+	if err := recordPoint(point); err != nil {
+		refusePoint(w, logger, params, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Send back a successful response
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// addPointError is the body of the errors of /addpoint. Error is the reason
+// of golivetracking_points_rejected_total, Field the refused parameter.
+type addPointError struct {
+	Error string `json:"error"`
+	Field string `json:"field,omitempty"`
+}
+
+// addPointErrors names the errors of /addpoint that are not a pointError.
+var addPointErrors = map[int]string{
+	http.StatusBadRequest:            rejectBadRequest,
+	http.StatusRequestEntityTooLarge: rejectBodyTooLarge,
+	http.StatusUnauthorized:          rejectUnauthorized,
+	http.StatusForbidden:             rejectForbidden,
+	http.StatusInternalServerError:   rejectStoreError,
+}
+
+// refusePoint logs and counts a point refused with a status of
+// addPointErrors, then answers it.
+func refusePoint(w http.ResponseWriter, logger *slog.Logger, params pointParams, status int, err error) {
+	reason := addPointErrors[status]
+	logRejectedPoint(logger, params, reason, err)
+	pointsRejected.WithLabelValues(reason).Inc()
+	writeAddPointError(w, status, err)
+}
+
+// authErrorStatus returns the status of a refused credential, the one
+// writeAuthError answers with.
+func authErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// writeAddPointError answers a point that is not stored. With
+// LegacyAddPointErrors every refused request gets the empty 200 of older
+// versions, which some trackers need to go on sending.
+func writeAddPointError(w http.ResponseWriter, status int, err error) {
+	if AppConfig.LegacyAddPointErrors {
+		if status == http.StatusInternalServerError {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	body := addPointError{Error: addPointErrors[status]}
+	var pe *pointError
+	if errors.As(err, &pe) {
+		body.Error, body.Field = pe.Reason, pe.Field
+	}
+	writeJSON(w, status, body)
+}
+
+// pointError is a value of a point refused by validatePoint.
+type pointError struct {
+	Field   string // parameter of the value
+	Reason  string // label of golivetracking_points_rejected_total
+	missing bool
+	msg     string
+}
+
+func (e *pointError) Error() string {
+	return e.msg
+}
 
-	if key != AppConfig.Key {
-		fmt.Println("Wrong key.")
+// rejectPoint returns the error of a refused value and counts the rejection.
+// problem is missing, not_numeric, too_long or out_of_range.
+func rejectPoint(field, problem, msg string) error {
+	e := &pointError{Field: field, Reason: field + "_" + problem, missing: problem == "missing", msg: msg}
+	pointsRejected.WithLabelValues(e.Reason).Inc()
+	return e
+}
+
+// pointErrorStatus returns the status of an error of validatePoint: 400 for a
+// missing parameter, which makes the request malformed, and 422 for a value
+// that is present but refused.
+func pointErrorStatus(err error) int {
+	var pe *pointError
+	if errors.As(err, &pe) && pe.missing {
+		return http.StatusBadRequest
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// logRejectedPoint logs a point that is not stored. The reason and field of
+// a pointError replace the given reason. Points refused by the store are
+// errors, the others are the fault of the sender.
+func logRejectedPoint(logger *slog.Logger, params pointParams, reason string, err error) {
+	attrs := []any{"user", params.User, "session", params.Session}
+	var pe *pointError
+	if errors.As(err, &pe) {
+		reason = pe.Reason
+		attrs = append(attrs, "field", pe.Field)
+	}
+	attrs = append(attrs, "reason", reason, "error", err)
+	if reason == rejectStoreError {
+		logger.Error("Point rejected", attrs...)
 		return
 	}
+	logger.Warn("Point rejected", attrs...)
+}
 
-	if AppConfig.ConsoleDebug {
-		fmt.Printf("lat => %s\nlon => %s\ntimestamp => %s\naltitude => %s\nspeed => %s\nbearing => %s\nHDOP => %s\nuser => %s\nsession => %s\nkey => %s\n",
-			sanitize(lat), sanitize(lon), sanitize(timestamp), sanitize(altitude), sanitize(speed), sanitize(bearing), sanitize(hdop), sanitize(user), sanitize(session), sanitize(key))
+// coordinateField names the coordinate a check failed for, the latitude when
+// latInvalid and otherwise the longitude.
+func coordinateField(latInvalid bool) string {
+	if latInvalid {
+		return "lat"
 	}
+	return "lon"
+}
+
+// validatePoint checks the raw values sent by a tracker and fills in the
+// defaults of the optional ones. The returned error describes the first
+// invalid value.
+func validatePoint(params pointParams) (Point, error) {
+	lat, lon := params.Lat, params.Lon
+	timestamp := params.Timestamp
+	altitude := params.Altitude
+	speed := params.Speed
+	bearing := params.Bearing
+	hdop := params.Hdop
+	acc := params.Acc
+	user := params.User
+	session := params.Session
 
 	// Data verification
 	if lat == "" || lon == "" {
-		fmt.Println("LAT/LON not found")
-		return
+		return Point{}, rejectPoint(coordinateField(lat == ""), "missing", "LAT/LON not found")
 	} else if !isNumeric(lat) || !isNumeric(lon) {
-		fmt.Println("LAT/LON Not number")
-		return
+		return Point{}, rejectPoint(coordinateField(!isNumeric(lat)), "not_numeric", "LAT/LON Not number")
 	} else if len(lat) > AppConfig.MaxGetParmLen || len(lon) > AppConfig.MaxGetParmLen {
-		fmt.Println("LAT/LON too big")
-		return
+		return Point{}, rejectPoint(coordinateField(len(lat) > AppConfig.MaxGetParmLen), "too_long", "LAT/LON too big")
 	}
 	if !isValidCoordinates(lat, lon) {
-		fmt.Println("Invalid coordinates")
-		return
+		return Point{}, rejectPoint(coordinateField(!isValidCoordinates(lat, "0")), "out_of_range", "Invalid coordinates")
 	}
 	if timestamp == "" {
 		timestamp = "0"
 	} else if !isNumeric(timestamp) {
-		fmt.Println("Timestamp not numeric")
-		return
+		return Point{}, rejectPoint("timestamp", "not_numeric", "Timestamp not numeric")
 	} else if len(timestamp) > AppConfig.MaxGetParmLen {
-		fmt.Println("Timestamp too big")
-		return
-	} else if AppConfig.ConvertTimestamp {
-		timestamp = fmt.Sprintf("%s", TimeStampConvert(timestamp))
+		return Point{}, rejectPoint("timestamp", "too_long", "Timestamp too big")
 	}
 	if altitude == "" {
 		altitude = "0"
 	} else if !isNumeric(altitude) {
-		fmt.Println("Altitude not numeric")
-		return
+		return Point{}, rejectPoint("altitude", "not_numeric", "Altitude not numeric")
 	} else if len(altitude) > AppConfig.MaxGetParmLen {
-		fmt.Println("Altitude too big")
-		return
+		return Point{}, rejectPoint("altitude", "too_long", "Altitude too big")
 	}
 	if speed == "" {
 		speed = "0"
 	} else if !isNumeric(speed) {
-		fmt.Println("Speed not numeric")
-		return
+		return Point{}, rejectPoint("speed", "not_numeric", "Speed not numeric")
 	} else if len(speed) > AppConfig.MaxGetParmLen {
-		fmt.Println("Speed too big")
-		return
+		return Point{}, rejectPoint("speed", "too_long", "Speed too big")
 	}
 	if bearing == "" {
 		bearing = "0"
+	} else if !isNumeric(bearing) {
+		return Point{}, rejectPoint("bearing", "not_numeric", "Bearing not numeric")
 	} else if len(bearing) > AppConfig.MaxGetParmLen {
-		fmt.Println("Bearing too big")
-		return
+		return Point{}, rejectPoint("bearing", "too_long", "Bearing too big")
 	}
 	if hdop == "" {
 		hdop = "0"
 	} else if !isNumeric(hdop) {
-		fmt.Println("HDOP not numeric")
-		return
+		return Point{}, rejectPoint("hdop", "not_numeric", "HDOP not numeric")
 	} else if len(hdop) > AppConfig.MaxGetParmLen {
-		fmt.Println("HDOP too big")
-		return
+		return Point{}, rejectPoint("hdop", "too_long", "HDOP too big")
+	}
+	if acc == "" {
+		acc = "0"
+	} else if !isNumeric(acc) {
+		return Point{}, rejectPoint("accuracy", "not_numeric", "Accuracy not numeric")
+	} else if len(acc) > AppConfig.MaxGetParmLen {
+		return Point{}, rejectPoint("accuracy", "too_long", "Accuracy too big")
 	}
 	if user == "" {
 		user = "0"
 	} else if !isNumeric(user) {
-		fmt.Println("User not numeric")
-		return
+		return Point{}, rejectPoint("user", "not_numeric", "User not numeric")
 	} else if len(user) > AppConfig.MaxGetParmLen {
-		fmt.Println("User too big")
-		return
+		return Point{}, rejectPoint("user", "too_long", "User too big")
 	}
 	if session == "" {
 		session = "0"
 	} else if !isNumeric(session) {
-		fmt.Println("Session not numeric")
-		return
+		return Point{}, rejectPoint("session", "not_numeric", "Session not numeric")
 	} else if len(session) > AppConfig.MaxGetParmLen {
-		fmt.Println("Session too big")
-		return
+		return Point{}, rejectPoint("session", "too_long", "Session too big")
 	}
 	//data verification finish...
 
-	_, err := stmtInsertPoint.Exec(lat, lon, altitude, speed, timestamp, bearing, hdop, user, session)
+	ts, _ := strconv.ParseFloat(timestamp, 64)
+	return Point{
+		Lat:     parseFloat(lat),
+		Lon:     parseFloat(lon),
+		Alt:     parseFloat(altitude),
+		Speed:   parseFloat(speed),
+		Time:    timestampMillis(int64(ts)),
+		Bearing: parseFloat(bearing),
+		Hdop:    parseFloat(hdop),
+		Acc:     parseFloat(acc),
+		User:    user,
+		Session: session,
+	}, nil
+}
+
+// recordPoint stores a validated point and publishes it to the live viewers.
+func recordPoint(p Point) error {
+	if err := liveSessions.assign(&p); err != nil {
+		return err
+	}
+	if err := store.InsertPoint(p); err != nil {
+		liveSessions.forget(p.User)
+		return err
+	}
+	pointStored(p)
+	return nil
+}
+
+// pointStored publishes a point received live and the geofence transitions
+// it causes. Imported history does not go through here.
+func pointStored(p Point) {
+	pointsAccepted.Inc()
+	sessionStats.invalidate(p.User, p.Session)
+	liveHub.Publish(p.LatLng())
+	mqttClient.publish(p)
+
+	events, err := geofences.check(p)
 	if err != nil {
-		http.Error(w, "Server Error", http.StatusInternalServerError)
-		log.Println("Insert exec error:", err)
-		return
-	} 
+		slog.Error("Geofence check error", "user", p.User, "session", p.Session, "error", err)
+	}
+	for i := range events {
+		liveHub.PublishGeofence(&events[i])
+	}
 
-	// Send back a successful response
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	webhooks.pointStored(p, events)
 }
 
-func sanitize(input string) string {
-	return strings.ReplaceAll(input, "\n", "")
+// LatLng converts a stored point into the structure sent over SSE,
+// formatting the values for display.
+func (p Point) LatLng() *LatLng {
+	return &LatLng{
+		User:      p.User,
+		Session:   p.Session,
+		Lat:       formatFloat(p.Lat),
+		Lng:       formatFloat(p.Lon),
+		Alt:       formatFloat(p.Alt),
+		Speed:     formatFloat(p.Speed),
+		Time:      formatTime(p.Time),
+		Bear:      formatFloat(p.Bearing),
+		Hdop:      formatFloat(p.Hdop),
+		Acc:       formatFloat(p.Acc),
+		Color:     userColor(p.User),
+		Timestamp: p.Time,
+	}
 }
 
 // eventsHandler serves an HTTP request to stream events.
+// The last known position is sent once on connect; afterwards every point
+// accepted by getAddPoint is pushed as soon as it is published on liveHub.
 func eventsHandler(w http.ResponseWriter, r *http.Request) {
-	user, session := sanitizeInput(r)
+	share, err := requestShare(r)
+	if err != nil {
+		writeShareError(w, r, err)
+		return
+	}
+
+	users, all := eventUsers(r)
+	_, session := sanitizeInput(r)
+	if share != nil {
+		users, all, session = []string{share.User}, false, share.eventSession()
+	}
 
+	// Each event gets its own write deadline, the one of the server would
+	// end the stream
+	w = streamWriter{w, http.NewResponseController(w)}
+	sseConnections.Inc()
+	defer sseConnections.Dec()
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	// Set refresh interval for the event stream.
-	refreshDuration, err := time.ParseDuration(AppConfig.EventRefreshTime)
+	// Set keep-alive interval for the event stream.
+	keepAliveDuration, err := time.ParseDuration(AppConfig.EventRefreshTime)
+	if err != nil {
+		requestLogger(r).Warn("Invalid refresh duration, using default", "error", err)
+		keepAliveDuration = 5 * time.Second // Use a sensible default
+	}
+
+	ctx := r.Context() // Use request context for handling cancellation.
+
+	// Subscribe before reading the last positions so no point can slip in between.
+	var updates <-chan *LatLng
+	var geofenceEvents <-chan *GeofenceEvent
+	if all || len(users) > 0 {
+		sub := liveHub.Subscribe(users, session)
+		defer liveHub.Unsubscribe(sub)
+		updates = sub.C
+		// The public and the shared maps do not show geofences
+		if share == nil && mayViewGeofences(r, users) {
+			geofenceEvents = sub.Geofences
+		}
+	}
+
+	var currentPoints []*LatLng
+	if all {
+		currentPoints, err = getLastKnownPositions(session)
+	} else {
+		for _, user := range users {
+			var point *LatLng
+			point, err = getLastKnownPosition(user, session)
+			if err != nil {
+				break
+			}
+			if point != nil {
+				currentPoints = append(currentPoints, point)
+			}
+		}
+	}
 	if err != nil {
-		log.Printf("Invalid refresh duration, using default: %v\n", err)
-		refreshDuration = 5 * time.Second // Use a sensible default
+		requestLogger(r).Error("Error querying database", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	ctx := r.Context()         // Use request context for handling cancellation.
-	previousPoint := &LatLng{} // Initialize previous point.
+	// Last point sent for each user.
+	previousPoints := make(map[string]*LatLng)
+	for _, point := range currentPoints {
+		if share != nil && !share.allows(point.Timestamp) {
+			continue
+		}
+		sendLocationEvent(w, point)
+		previousPoints[point.User] = point
+	}
 
-	ticker := time.NewTicker(refreshDuration)
+	ticker := time.NewTicker(keepAliveDuration)
 	defer ticker.Stop()
 
+	// A shared stream ends when the share expires.
+	var expired <-chan time.Time
+	if share != nil {
+		timer := time.NewTimer(time.Until(time.UnixMilli(share.ExpiresAt)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			// Client has disconnected.
 			return
-		case <-ticker.C:
-			currentPoint, err := getLastKnownPosition(user, session)
-			if err != nil {
-				log.Printf("Error querying database: %v\n", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+		case <-liveHub.Done():
+			// The server is shutting down, the client reconnects later.
+			return
+		case point := <-updates:
+			if share != nil && !share.allows(point.Timestamp) {
+				continue
 			}
-
 			// Send location only if it's new data.
-			if currentPoint != nil && !currentPoint.Equal(previousPoint) {
-				sendLocationEvent(w, currentPoint)
-				*previousPoint = *currentPoint // Update the last sent location.
+			if previous, ok := previousPoints[point.User]; !ok || !point.Equal(previous) {
+				sendLocationEvent(w, point)
+				previousPoints[point.User] = point // Update the last sent location.
 			}
+		case ev := <-geofenceEvents:
+			sendGeofenceEvent(w, ev)
+		case <-ticker.C:
+			// Close the stream of a share revoked in the meantime.
+			if share != nil && shareRevoked(share) {
+				sendShareExpired(w)
+				return
+			}
+			// Keep proxies from closing an idle stream.
+			sendKeepAlive(w)
+		case <-expired:
+			sendShareExpired(w)
+			return
 		}
 	}
 }
 
+// sendKeepAlive writes an SSE comment line, which clients ignore.
+func sendKeepAlive(w http.ResponseWriter) {
+	fmt.Fprint(w, ": keep-alive\n\n")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Equal checks if this point equals another one.
 func (a *LatLng) Equal(b *LatLng) bool {
 	return a.Lat == b.Lat && a.Lng == b.Lng && a.Alt == b.Alt && a.Speed == b.Speed && a.Time == b.Time && a.Bear == b.Bear && a.Hdop == b.Hdop
@@ -648,31 +1015,53 @@ func sanitizeInput(r *http.Request) (user string, session string) {
 	return user, session
 }
 
+// eventUsers returns the users requested on /events. It accepts a single user
+// (?user=1), a comma separated list (?users=1,2,3) or every user (?user=all).
+func eventUsers(r *http.Request) (users []string, all bool) {
+	if r.URL.Query().Get("user") == "all" {
+		return nil, true
+	}
+	if list := r.URL.Query().Get("users"); list != "" {
+		for _, user := range strings.Split(list, ",") {
+			if user != "" && isValidParam(user, AppConfig.MaxGetParmLen) {
+				users = append(users, user)
+			}
+		}
+		return users, false
+	}
+	user, _ := sanitizeInput(r)
+	if user == "0" {
+		return nil, false
+	}
+	return []string{user}, false
+}
+
+// getLastKnownPositions retrieves the last known position of every user,
+// optionally restricted to a session.
+func getLastKnownPositions(session string) ([]*LatLng, error) {
+	positions, err := store.LastPositions(session)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]*LatLng, 0, len(positions))
+	for _, p := range positions {
+		points = append(points, p.LatLng())
+	}
+	return points, nil
+}
+
 // getLastKnownPosition retrieves the last known position for a user and session from the database.
 func getLastKnownPosition(user string, session string) (*LatLng, error) {
 	if user == "0" {
 		return nil, nil
 	}
 
-	// Decide which prepared statement to use based on the session value
-	var stmt *sql.Stmt
-	var args []interface{}
-	if session != "0" {
-		stmt = stmtWithUserAndSession
-		args = []interface{}{user, session}
-	} else {
-		stmt = stmtWithUserOnly
-		args = []interface{}{user}
-	}
-
-	// Scan the result into the LatLng struct.
-	var point LatLng
-	err := stmt.QueryRow(args...).Scan(&point.Lat, &point.Lng, &point.Alt, &point.Speed, &point.Time, &point.Bear, &point.Hdop, &point.User, &point.Session)
-	if err != nil {
+	point, err := store.LastPosition(user, session)
+	if err != nil || point == nil {
 		return nil, err
 	}
-
-	return &point, nil
+	return point.LatLng(), nil
 }
 
 // sendLocationEvent is a function that sends an event containing location information.
@@ -680,7 +1069,7 @@ func sendLocationEvent(w http.ResponseWriter, point *LatLng) {
 	// Marshals (convert into JSON format) lat lng data and checks if there are any errors during the process
 	data, err := json.Marshal(point)
 	if err != nil { // If error occurs while marshaling...
-		log.Printf("Error marshaling JSON: %v\n", err)                         // Log this unexpected event for debugging purpose
+		slog.Error("Error marshaling JSON", "error", err)                      // Log this unexpected event for debugging purpose
 		http.Error(w, "Error marshaling JSON", http.StatusInternalServerError) // Return an internal server error to the client
 		return
 	}
@@ -691,82 +1080,106 @@ func sendLocationEvent(w http.ResponseWriter, point *LatLng) {
 	if flusher, ok := w.(http.Flusher); ok { // Attempt to get a reference of Flusher from ResponseWriter
 		flusher.Flush() // Flush any buffered data immediately in case we want server send event as soon as possible
 	} else {
-		log.Println("Streaming unsupported!")
+		slog.Warn("Streaming unsupported")
 	}
 }
 
-func getGpxTrack(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func getGpxTrack(w http.ResponseWriter, r *http.Request) {
+	// A long track takes more than the write timeout of the server to send
+	w = streamWriter{w, http.NewResponseController(w)}
+
 	// Validate key, user, and session parameters
-	if err := validateRequestParameters(r); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	user, err := validateRequestParameters(r)
+	if err != nil {
+		writeExportError(w, r, err)
 		return
 	}
 
-	user := r.URL.Query().Get("user")
 	session := r.URL.Query().Get("session")
 	if session == "" {
 		session = "0"
 	}
 
 	// Fetch GPS track data
-	points, err := fetchGpsTrack(db, user, session)
+	track, err := store.FetchTrack(user, session)
 	if err != nil {
 		http.Error(w, "Query error", http.StatusInternalServerError)
 		return
 	}
 
-	// Create GPX structure and populate it with track data
-	gpx := createGpxStructure("GoLiveTracking", points)
+	// Create GPX structure and populate it with track data, one segment
+	// between every gap when session splitting is configured
+	gpx := createGpxStructure("GoLiveTracking", splitTrack(track))
 
 	// Write the GPX file as the HTTP response
 	writeGpxResponse(w, gpx)
 }
 
-func validateRequestParameters(r *http.Request) error {
-	key := r.URL.Query().Get("key")
-	if key != AppConfig.Key {
-		return fmt.Errorf(http.StatusText(http.StatusUnauthorized))
+// Errors of validateRequestParameters for the user and session parameters
+var (
+	errInvalidUser    = errors.New("Invalid user parameter")
+	errInvalidSession = errors.New("Invalid session parameter")
+)
+
+// validateRequestParameters checks the key, user and session of an export and
+// returns the user, which a device token may leave out. A refused key is
+// returned as the error of authorizeUser.
+func validateRequestParameters(r *http.Request) (string, error) {
+	user, err := authorizeUser(requestKey(r), r.URL.Query().Get("user"))
+	if err != nil {
+		return "", err
 	}
 
-	user := r.URL.Query().Get("user")
 	if user == "" || !isNumeric(user) || len(user) > AppConfig.MaxGetParmLen {
-		return fmt.Errorf("Invalid user parameter")
+		return "", errInvalidUser
 	}
 
 	session := r.URL.Query().Get("session")
 	if session != "" && (!isNumeric(session) || len(session) > AppConfig.MaxGetParmLen) {
-		return fmt.Errorf("Invalid session parameter")
+		return "", errInvalidSession
 	}
 
-	return nil
+	return user, nil
 }
 
-func fetchGpsTrack(db *sql.DB, user, session string) ([]GPXPoint, error) {
-	var points []GPXPoint
+// writeExportError answers an export refused by validateRequestParameters.
+func writeExportError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errInvalidUser) || errors.Is(err, errInvalidSession) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAuthError(w, r, err)
+}
 
-	rows, err := stmtFetchGpsTrack.Query(user, session)
+func fetchGpsTrack(user, session string) ([]GPXPoint, error) {
+	track, err := store.FetchTrack(user, session)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return gpxPoints(track), nil
+}
 
-	for rows.Next() {
-		var p GPXPoint
-		if err := rows.Scan(&p.Latitude, &p.Longitude, &p.Elevation, &p.Time); err != nil {
-			return nil, err
+// gpxPoints converts stored points into GPX track points.
+func gpxPoints(track []Point) []GPXPoint {
+	points := make([]GPXPoint, 0, len(track))
+	for _, t := range track {
+		p := GPXPoint{Latitude: t.Lat, Longitude: t.Lon, Elevation: t.Alt}
+		if t.Time != 0 {
+			p.Time = time.UnixMilli(t.Time).UTC().Format(time.RFC3339)
 		}
 		points = append(points, p)
 	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return points, nil
+	return points
 }
 
-func createGpxStructure(creator string, points []GPXPoint) GPX {
-	track := Track{Name: "GPS Track", Segments: []Segment{{Points: points}}}
+func createGpxStructure(creator string, parts [][]Point) GPX {
+	track := Track{Name: "GPS Track", Segments: []Segment{}}
+	for _, part := range parts {
+		track.Segments = append(track.Segments, Segment{Points: gpxPoints(part)})
+	}
+	if len(track.Segments) == 0 {
+		track.Segments = append(track.Segments, Segment{Points: []GPXPoint{}})
+	}
 	return GPX{Version: "1.1", Creator: creator, Tracks: []Track{track}}
 }
 
@@ -774,11 +1187,14 @@ func writeGpxResponse(w http.ResponseWriter, gpx GPX) {
 	w.Header().Set("Content-Disposition", "attachment; filename=my_gps_track.gpx")
 	w.Header().Set("Content-Type", "application/gpx+xml")
 
-	enc := xml.NewEncoder(w)
+	out := &countingWriter{w: w}
+	enc := xml.NewEncoder(out)
 	enc.Indent("", "    ")
 	if err := enc.Encode(gpx); err != nil {
 		http.Error(w, "Error writing GPX file", http.StatusInternalServerError)
+		return
 	}
+	gpxExportBytes.Observe(float64(out.n))
 }
 
 func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) {
@@ -788,22 +1204,24 @@ func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) {
 	}
 }
 
+// isNumeric reports whether s is a finite number. ParseFloat also accepts NaN
+// and Inf, which are not positions nor measurements.
 func isNumeric(s string) bool {
-	_, err := strconv.ParseFloat(s, 64)
-	return err == nil
+	f, err := strconv.ParseFloat(s, 64)
+	return err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
 }
 
 func ReadConfig() {
 	f, err := os.Open(configPath)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("Cannot open the configuration", "error", err)
 	}
 	defer f.Close()
 
 	decoder := yaml.NewDecoder(f)
 	err = decoder.Decode(&AppConfig)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("Cannot read the configuration", "error", err)
 	}
 }
 
@@ -811,26 +1229,57 @@ func ReadConfig() {
 func TimeStampConvert(e string) (dtime time.Time) {
 	// Parsing inputted String to Int64, assuming the provided 'string' is in base-10 representation of integer
 	data, err := strconv.ParseInt(e, 10, 64)
-	if err != nil { // If there were any errors during parsing operation then it prints out error and returns zero value for time.
-		fmt.Println(err)
+	if err != nil { // If there were any errors during parsing operation then it logs the error and returns zero value for time.
+		slog.Warn("Invalid timestamp", "error", err)
 	}
 	// Load the location based on the application's configured timezone
 	loc, err := time.LoadLocation(AppConfig.TimeZone)
-	if err != nil { // If there were any errors during loading operation then it prints out error and returns zero value for time.
-		fmt.Println(err)
+	if err != nil { // If there were any errors during loading operation then it logs the error and returns zero value for time.
+		slog.Warn("Invalid time zone", "error", err)
+	}
+
+	// Check if the timestamp is in milliseconds or seconds format
+	if data > 10000000000 { // milliseconds
+		// Convert milliseconds to seconds and create a time object
+		dtime = time.Unix(data/1000, 0).In(loc)
+	} else { // seconds
+		// Create a time object directly from the seconds value
+		dtime = time.Unix(data, 0).In(loc)
+	}
+	return dtime // Returning final computed Unix timestamp in specific Timezone.
+}
+
+// timestampMillis converts a Unix timestamp in seconds or milliseconds
+// into milliseconds.
+func timestampMillis(data int64) int64 {
+	if data > 10000000000 || data < -10000000000 { // milliseconds
+		return data
+	}
+	return data * 1000
+}
+
+// formatTime renders a stored time for display. With ConvertTimestamp it is
+// converted into a human readable date in the configured time zone.
+func formatTime(ms int64) string {
+	if ms == 0 {
+		return "0"
+	}
+	if !AppConfig.ConvertTimestamp {
+		return strconv.FormatInt(ms, 10)
 	}
-	
-    // Check if the timestamp is in milliseconds or seconds format
-    if data > 10000000000 { // milliseconds
-        // Convert milliseconds to seconds and create a time object
-        dtime = time.Unix(data/1000, 0).In(loc)
-    } else { // seconds
-        // Create a time object directly from the seconds value
-        dtime = time.Unix(data, 0).In(loc)
-    }
-	return dtime                            // Returning final computed Unix timestamp in specific Timezone.
+	return TimeStampConvert(strconv.FormatInt(ms, 10)).String()
 }
 
+// parseFloat converts a validated value, returning 0 when it is not a number.
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// formatFloat renders a stored number with as few digits as needed.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
 
 func isSafeString(str string) bool {
 	if str == "" {
@@ -839,61 +1288,6 @@ func isSafeString(str string) bool {
 	return safeString.MatchString(str)
 }
 
-func CreateDB() {
-	db, err := sql.Open("sqlite3", "sqlite-database.db")
-	checkErr(err)
-	fmt.Println("Database connection established.")
-
-	// Create the Points table
-	_, err = db.Exec(`
-        CREATE TABLE Points (
-            ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-            LAT STRING NOT NULL,
-            LON STRING NOT NULL,
-            ALT STRING NOT NULL,
-            SPEED STRING NOT NULL,
-            TIME STRING NOT NULL,
-            BEARING STRING NOT NULL,
-            HDOP STRING NOT NULL,
-            USER STRING NOT NULL,
-            SESSION STRING NOT NULL
-        );
-    `)
-	checkErr(err)
-	fmt.Println("Table 'Points' created successfully.")
-
-	_, err = db.Exec("CREATE INDEX idx_user ON Points(USER);")
-	checkErr(err)
-	fmt.Println("Index 'idx_user' created successfully.")
-
-	_, err = db.Exec("CREATE INDEX idx_session ON Points(SESSION);")
-	checkErr(err)
-	fmt.Println("Index 'idx_session' created successfully.")
-
-	_, err = db.Exec("CREATE INDEX idx_user_session ON Points(USER, SESSION);")
-	checkErr(err)
-	fmt.Println("Index 'idx_user_session' created successfully.")
-
-	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='index';")
-	checkErr(err)
-	defer rows.Close()
-
-	var indexName string
-	for rows.Next() {
-		err := rows.Scan(&indexName)
-		checkErr(err)
-		fmt.Println("Found index:", indexName)
-	}
-	fmt.Println("Index verification completed.")
-}
-
-func checkErr(err error, args ...string) {
-	if err != nil {
-		fmt.Println("Error")
-		fmt.Println(err, " : ", args)
-	}
-}
-
 // Function that validates if given latitude and longitude values are within the valid range for GPS coordinates.
 func isValidCoordinates(lat, lon string) bool {
 	// Convert Latitude from String to Float64 type
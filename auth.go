@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errUnauthorized = errors.New("wrong key")
+	errForbidden    = errors.New("key not allowed for this user")
+)
+
+// credential is the identity behind the key of a request. Device tokens can
+// only act as the user of their device, the legacy shared Key as any user
+// without a device, the admin key as any user, and only the admin key can run
+// admin operations.
+type credential struct {
+	Admin  bool
+	Shared bool
+	Device *Device
+}
+
+// hashKey returns the hex SHA-256 of a key, the form in which device and
+// share tokens are stored. Tokens are random, so a fast hash is enough.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// equalHash compares two key hashes in constant time.
+func equalHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// hashAdminKey returns the bcrypt hash of an admin key for AdminKeyHash. The
+// admin key is chosen by a person, so it gets a slow, salted hash.
+func hashAdminKey(key string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkAdminKeyHash refuses an AdminKeyHash that is not a bcrypt hash.
+func checkAdminKeyHash(cfg Cfg) error {
+	if cfg.AdminKeyHash == "" {
+		return nil
+	}
+	if _, err := bcrypt.Cost([]byte(cfg.AdminKeyHash)); err != nil {
+		return fmt.Errorf("AdminKeyHash is not a bcrypt hash, generate it with hash-key: %w", err)
+	}
+	return nil
+}
+
+// adminKeyCache remembers the SHA-256 of the last key that matched
+// AdminKeyHash, so only the first request with the admin key pays for bcrypt.
+var adminKeyCache struct {
+	sync.Mutex
+	adminKeyHash string
+	keyHash      string
+}
+
+// isAdminKey reports whether key matches AdminKeyHash.
+func isAdminKey(key string) bool {
+	if AppConfig.AdminKeyHash == "" {
+		return false
+	}
+	hash := hashKey(key)
+	adminKeyCache.Lock()
+	cached := adminKeyCache.adminKeyHash == AppConfig.AdminKeyHash && equalHash(hash, adminKeyCache.keyHash)
+	adminKeyCache.Unlock()
+	if cached {
+		return true
+	}
+
+	// CompareHashAndPassword compares in constant time
+	if bcrypt.CompareHashAndPassword([]byte(AppConfig.AdminKeyHash), []byte(key)) != nil {
+		return false
+	}
+	adminKeyCache.Lock()
+	adminKeyCache.adminKeyHash, adminKeyCache.keyHash = AppConfig.AdminKeyHash, hash
+	adminKeyCache.Unlock()
+	return true
+}
+
+// newToken returns a random device token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// requestKey returns the key of a request, from an "Authorization: Bearer"
+// header or the key parameter.
+func requestKey(r *http.Request) string {
+	if token, ok := bearerToken(r); ok {
+		return token
+	}
+	return r.URL.Query().Get("key")
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+// authenticate finds the credential a key belongs to. The admin key is
+// checked last, as its bcrypt hash is slow to compare.
+func authenticate(key string) (credential, error) {
+	if key == "" {
+		return credential{}, errUnauthorized
+	}
+	hash := hashKey(key)
+	if AppConfig.Key != "" && equalHash(hash, hashKey(AppConfig.Key)) {
+		return credential{Shared: true}, nil
+	}
+
+	device, err := store.DeviceByTokenHash(hash)
+	if err != nil {
+		return credential{}, err
+	}
+	if device != nil {
+		return credential{Device: device}, nil
+	}
+	if isAdminKey(key) {
+		return credential{Admin: true}, nil
+	}
+	return credential{}, errUnauthorized
+}
+
+// resolveUser returns the user a request acts as. Device tokens default to
+// their own user and are refused for any other. The legacy shared Key is
+// refused for the users with an active device, which have their own tokens.
+func (c credential) resolveUser(user string) (string, error) {
+	if c.Shared && user != "" {
+		hasDevices, err := store.HasDevices(user)
+		if err != nil {
+			return "", err
+		}
+		if hasDevices {
+			return "", errForbidden
+		}
+	}
+	if c.Device == nil {
+		return user, nil
+	}
+	if user == "" {
+		return c.Device.User, nil
+	}
+	if user != c.Device.User {
+		return "", errForbidden
+	}
+	return user, nil
+}
+
+// authorizeUser authenticates key and checks that it may act as user, see
+// resolveUser.
+func authorizeUser(key, user string) (string, error) {
+	cred, err := authenticate(key)
+	if err != nil {
+		return "", err
+	}
+	return cred.resolveUser(user)
+}
+
+// requireAdmin checks that the request carries the admin key and answers it
+// with an error otherwise.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	cred, err := authenticate(requestKey(r))
+	if err == nil && !cred.Admin {
+		err = errForbidden
+	}
+	if err != nil {
+		writeAuthError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// writeAuthError answers a request whose credential was refused.
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errUnauthorized):
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case errors.Is(err, errForbidden):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	default:
+		requestLogger(r).Error("Authentication error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+	}
+}
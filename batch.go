@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// maxBatchBodySize limits the body accepted by the batch upload.
+const maxBatchBodySize = 16 << 20
+
+// Status of a single item of a batch upload
+const (
+	batchStatusOK        = "ok"
+	batchStatusDuplicate = "duplicate"
+	batchStatusRejected  = "rejected"
+)
+
+// flexString accepts both JSON strings and numbers, so items can be sent
+// either way.
+type flexString string
+
+func (f *flexString) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*f = flexString(s)
+		return nil
+	}
+	*f = flexString(b)
+	return nil
+}
+
+// batchPoint is one item of a batch upload, using the /addpoint parameter names.
+type batchPoint struct {
+	Lat       flexString `json:"lat"`
+	Lon       flexString `json:"lon"`
+	Timestamp flexString `json:"timestamp"`
+	Altitude  flexString `json:"altitude"`
+	Speed     flexString `json:"speed"`
+	Bearing   flexString `json:"bearing"`
+	Hdop      flexString `json:"hdop"`
+	Acc       flexString `json:"acc"`
+	User      flexString `json:"user"`
+	Session   flexString `json:"session"`
+}
+
+func (b batchPoint) params() pointParams {
+	return pointParams{
+		Lat:       string(b.Lat),
+		Lon:       string(b.Lon),
+		Timestamp: normalizeTimestamp(string(b.Timestamp)),
+		Altitude:  string(b.Altitude),
+		Speed:     string(b.Speed),
+		Bearing:   string(b.Bearing),
+		Hdop:      string(b.Hdop),
+		Acc:       string(b.Acc),
+		User:      string(b.User),
+		Session:   string(b.Session),
+	}
+}
+
+type batchResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Accepted   int           `json:"accepted"`
+	Duplicates int           `json:"duplicates"`
+	Rejected   int           `json:"rejected"`
+	Results    []batchResult `json:"results"`
+}
+
+// postPointsBatch stores a backlog of points sent as a JSON array or as NDJSON.
+// Every item is validated like a single /addpoint request, the valid ones are
+// inserted in one transaction and a result is returned for each item.
+func postPointsBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	cred, err := authenticate(requestKey(r))
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+
+	// A large backlog takes more than the timeouts of the server to upload
+	// and store
+	rc := http.NewResponseController(w)
+	w = streamWriter{w, rc}
+	r.Body = http.MaxBytesReader(w, streamReader{r.Body, rc}, maxBatchBodySize)
+	items, err := decodeBatch(r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := batchResponse{Results: make([]batchResult, len(items))}
+	var points []Point
+	var indexes []int
+	for i, item := range items {
+		resp.Results[i].Index = i
+		params := item.params()
+		params.User, err = cred.resolveUser(params.User)
+		if err != nil {
+			resp.Results[i].Status = batchStatusRejected
+			resp.Results[i].Error = err.Error()
+			resp.Rejected++
+			continue
+		}
+		point, err := validatePoint(params)
+		if err != nil {
+			resp.Results[i].Status = batchStatusRejected
+			resp.Results[i].Error = err.Error()
+			resp.Rejected++
+			continue
+		}
+		points = append(points, point)
+		indexes = append(indexes, i)
+	}
+
+	// The points of a retried batch are found before AutoSessions gives them
+	// a session, which can differ from the one they were stored in
+	var fresh []Point
+	var freshIndexes []int
+	for i, p := range points {
+		found, err := store.PointExists(p, AppConfig.AutoSessions && p.Session == "0")
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			requestLogger(r).Error("Batch duplicate check error", "error", err)
+			return
+		}
+		if found {
+			resp.Results[indexes[i]].Status = batchStatusDuplicate
+			resp.Duplicates++
+			continue
+		}
+		fresh = append(fresh, p)
+		freshIndexes = append(freshIndexes, indexes[i])
+	}
+	points, indexes = fresh, freshIndexes
+
+	for i := range points {
+		if err := liveSessions.assign(&points[i]); err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			requestLogger(r).Error("Batch session error", "error", err)
+			return
+		}
+	}
+
+	inserted, err := store.InsertPoints(points)
+	if err != nil {
+		for _, p := range points {
+			liveSessions.forget(p.User)
+		}
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Batch insert error", "error", err)
+		return
+	}
+	for i, ok := range inserted {
+		if ok {
+			resp.Results[indexes[i]].Status = batchStatusOK
+			resp.Accepted++
+			pointStored(points[i])
+		} else {
+			resp.Results[indexes[i]].Status = batchStatusDuplicate
+			resp.Duplicates++
+		}
+	}
+
+	requestLogger(r).Info("Batch stored", "points", len(items), "accepted", resp.Accepted, "duplicates", resp.Duplicates, "rejected", resp.Rejected)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// decodeBatch reads the items of a batch upload. NDJSON is used when the
+// content type says so or when the body does not start with a JSON array.
+func decodeBatch(r *http.Request) ([]batchPoint, error) {
+	br := bufio.NewReader(r.Body)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isArray := false
+	if mediaType != "application/x-ndjson" && mediaType != "application/ndjson" {
+		for {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+				continue
+			}
+			br.UnreadByte()
+			isArray = c == '['
+			break
+		}
+	}
+
+	dec := json.NewDecoder(br)
+	if isArray {
+		var items []batchPoint
+		if err := dec.Decode(&items); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+		return items, nil
+	}
+
+	var items []batchPoint
+	for line := 1; ; line++ {
+		var item batchPoint
+		err := dec.Decode(&item)
+		if err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid NDJSON item %d: %w", line, err)
+		}
+		items = append(items, item)
+	}
+}
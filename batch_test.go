@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBatch sends a batch upload with the shared key and decodes the answer
+// when it succeeds.
+func postBatch(t *testing.T, contentType, body string) (int, batchResponse) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/points/batch?key=secret", strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	postPointsBatch(w, r)
+
+	var resp batchResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+// batchStatuses returns the status of each item of a batch answer.
+func batchStatuses(resp batchResponse) []string {
+	statuses := make([]string, len(resp.Results))
+	for i, res := range resp.Results {
+		statuses[i] = res.Status
+	}
+	return statuses
+}
+
+func TestBatchFormats(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"array", "application/json", ` [{"lat":45.1,"lon":9.1,"timestamp":1714550400,"user":"1","session":"2"},
+			{"lat":"45.2","lon":"9.2","timestamp":"1714550401","user":"1","session":"2"}]`},
+		{"ndjson", "application/x-ndjson", `{"lat":45.1,"lon":9.1,"timestamp":1714550400,"user":"1","session":"2"}
+{"lat":"45.2","lon":"9.2","timestamp":"1714550401","user":"1","session":"2"}
+`},
+		{"ndjson without content type", "", `{"lat":45.1,"lon":9.1,"timestamp":1714550400,"user":"1","session":"2"}
+{"lat":"45.2","lon":"9.2","timestamp":"1714550401","user":"1","session":"2"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTestStore(t)
+			useTestConfig(t, Cfg{MaxGetParmLen: 20, Key: "secret"})
+			status, resp := postBatch(t, tc.contentType, tc.body)
+			if status != http.StatusOK || resp.Accepted != 2 {
+				t.Errorf("status %d, accepted %d, want 200 and 2", status, resp.Accepted)
+			}
+			if got := storedSessions(t); len(got) != 2 {
+				t.Errorf("stored points = %v, want 2", got)
+			}
+		})
+	}
+}
+
+func TestBatchInvalidBody(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, Cfg{MaxGetParmLen: 20, Key: "secret"})
+	for _, body := range []string{`[{"lat":45.1,`, "{\"lat\":45.1}\nnot json\n"} {
+		if status, _ := postBatch(t, "", body); status != http.StatusBadRequest {
+			t.Errorf("body %q: status %d, want 400", body, status)
+		}
+	}
+	if got := storedSessions(t); len(got) != 0 {
+		t.Errorf("stored points = %v, want none", got)
+	}
+}
+
+func TestBatchRejects(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, Cfg{MaxGetParmLen: 20, Key: "secret"})
+	// The shared key cannot send the points of a user with a device
+	_, err := store.AddDevice(Device{User: "3", Name: "phone", TokenHash: "hash", CreatedAt: 1})
+	must(t, err)
+
+	status, resp := postBatch(t, "", `[
+		{"lat":45.1,"lon":9.1,"timestamp":1714550400,"user":"1","session":"2"},
+		{"lon":9.1,"timestamp":1714550401,"user":"1","session":"2"},
+		{"lat":"NaN","lon":9.1,"timestamp":1714550402,"user":"1","session":"2"},
+		{"lat":95,"lon":9.1,"timestamp":1714550403,"user":"1","session":"2"},
+		{"lat":45.1,"lon":9.1,"timestamp":1714550404,"user":"1x","session":"2"},
+		{"lat":45.1,"lon":9.1,"timestamp":1714550405,"user":"3","session":"2"}]`)
+	if status != http.StatusOK {
+		t.Fatalf("status %d, want 200", status)
+	}
+	want := []string{batchStatusOK, batchStatusRejected, batchStatusRejected, batchStatusRejected, batchStatusRejected, batchStatusRejected}
+	if got := batchStatuses(resp); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	for _, res := range resp.Results[1:] {
+		if res.Error == "" {
+			t.Errorf("item %d rejected without error", res.Index)
+		}
+	}
+	if resp.Accepted != 1 || resp.Rejected != 5 {
+		t.Errorf("accepted %d, rejected %d, want 1 and 5", resp.Accepted, resp.Rejected)
+	}
+	if got := storedSessions(t); len(got) != 1 {
+		t.Errorf("stored points = %v, want 1", got)
+	}
+}
+
+func TestBatchDuplicates(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, Cfg{MaxGetParmLen: 20, Key: "secret"})
+	must(t, recordPoint(Point{Lat: 45.1, Lon: 9.1, Time: 1714550400000, User: "1", Session: "2"}))
+
+	// The first item is stored already, the third repeats the second and
+	// the fifth the timeless fourth
+	status, resp := postBatch(t, "application/x-ndjson", `{"lat":45.1,"lon":9.1,"timestamp":1714550400,"user":"1","session":"2"}
+{"lat":45.2,"lon":9.2,"timestamp":1714550401,"user":"1","session":"2"}
+{"lat":45.2,"lon":9.2,"timestamp":1714550401,"user":"1","session":"2"}
+{"lat":45.3,"lon":9.3,"user":"1","session":"2"}
+{"lat":45.3,"lon":9.3,"user":"1","session":"2"}
+`)
+	if status != http.StatusOK {
+		t.Fatalf("status %d, want 200", status)
+	}
+	want := []string{batchStatusDuplicate, batchStatusOK, batchStatusDuplicate, batchStatusOK, batchStatusDuplicate}
+	if got := batchStatuses(resp); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if resp.Accepted != 2 || resp.Duplicates != 3 {
+		t.Errorf("accepted %d, duplicates %d, want 2 and 3", resp.Accepted, resp.Duplicates)
+	}
+	if got := storedSessions(t); len(got) != 3 {
+		t.Errorf("stored points = %v, want 3", got)
+	}
+}
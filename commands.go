@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runCommand runs the maintenance command named by the first argument.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "import-gpx":
+		return importGpxCommand(args[1:])
+	case "add-device":
+		return addDeviceCommand(args[1:])
+	case "list-devices":
+		return listDevicesCommand()
+	case "revoke-device":
+		return revokeDeviceCommand(args[1:])
+	case "hash-key":
+		return hashKeyCommand(args[1:])
+	case "split-sessions":
+		return splitSessionsCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q, available commands: import-gpx, add-device, list-devices, revoke-device, hash-key, split-sessions", args[0])
+	}
+}
+
+// importGpxCommand imports GPX files for a user:
+//
+//	GOLiveTracking import-gpx -user 1 [-session 5] [-split trk|trkseg] track.gpx...
+func importGpxCommand(args []string) error {
+	fs := flag.NewFlagSet("import-gpx", flag.ContinueOnError)
+	user := fs.String("user", "", "user number the points belong to")
+	session := fs.String("session", "", "first session number (default: next unused session of the user)")
+	split := fs.String("split", "", `start a new session for every "trk" or "trkseg"`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: import-gpx -user N [-session N] [-split trk|trkseg] file.gpx...")
+	}
+
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		gpx, err := parseGpx(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		result, err := importGpx(gpx, *user, *session, *split)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Printf("%s: %d points imported in session(s) %v, %d duplicates, %d rejected\n",
+			name, result.Imported, result.Sessions, result.Duplicates, result.Rejected)
+	}
+	return nil
+}
+
+// addDeviceCommand creates a device and prints its token:
+//
+//	GOLiveTracking add-device -user 1 [-name phone]
+func addDeviceCommand(args []string) error {
+	fs := flag.NewFlagSet("add-device", flag.ContinueOnError)
+	user := fs.String("user", "", "user number the device sends points for")
+	name := fs.String("name", "", "name to recognize the device")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	device, err := createDevice(*user, *name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Device %d created for user %s, token (shown only once): %s\n", device.ID, device.User, device.Token)
+	return nil
+}
+
+// listDevicesCommand prints every device, revoked ones included.
+func listDevicesCommand() error {
+	devices, err := store.Devices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		status := "active"
+		if d.RevokedAt != 0 {
+			status = "revoked " + time.UnixMilli(d.RevokedAt).Format(time.DateTime)
+		}
+		fmt.Printf("%d\tuser %s\t%s\tcreated %s\t%s\n", d.ID, d.User, d.Name, time.UnixMilli(d.CreatedAt).Format(time.DateTime), status)
+	}
+	return nil
+}
+
+// revokeDeviceCommand revokes a device by id:
+//
+//	GOLiveTracking revoke-device 3
+func revokeDeviceCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: revoke-device ID")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid device id %q", args[0])
+	}
+
+	revoked, err := store.RevokeDevice(id, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return fmt.Errorf("no active device %d", id)
+	}
+	fmt.Printf("Device %d revoked\n", id)
+	return nil
+}
+
+// hashKeyCommand prints the bcrypt hash of a key for AdminKeyHash in
+// config.yaml:
+//
+//	GOLiveTracking hash-key my-admin-key
+func hashKeyCommand(args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return fmt.Errorf("usage: hash-key KEY")
+	}
+	hash, err := hashAdminKey(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+// splitSessionsCommand re-segments stored sessions with SessionSplitGap and
+// SessionSplitDistance, for one user or every user, one session or all of
+// them:
+//
+//	GOLiveTracking split-sessions [-user 1] [-session 0 | -all] [-dry-run]
+func splitSessionsCommand(args []string) error {
+	fs := flag.NewFlagSet("split-sessions", flag.ContinueOnError)
+	user := fs.String("user", "", "user number (default: every user)")
+	session := fs.String("session", "0", "session to split")
+	all := fs.Bool("all", false, "split every session of the users")
+	dryRun := fs.Bool("dry-run", false, "only print how the sessions would be split")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *all && flagSet(fs, "session") {
+		return fmt.Errorf("-session and -all cannot be used together")
+	}
+	if !sessionSplitEnabled() {
+		return fmt.Errorf("set SessionSplitGap or SessionSplitDistance in config.yaml first")
+	}
+
+	users := []string{*user}
+	if *user == "" {
+		last, err := store.LastPositions("0")
+		if err != nil {
+			return err
+		}
+		users = users[:0]
+		for _, p := range last {
+			users = append(users, p.User)
+		}
+	}
+
+	verb := "split"
+	if *dryRun {
+		verb = "would be split"
+	}
+	for _, u := range users {
+		sessions := []string{*session}
+		if *all {
+			var err error
+			if sessions, err = store.Sessions(u); err != nil {
+				return fmt.Errorf("user %s: %w", u, err)
+			}
+		}
+		last, err := store.MaxSession(u)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", u, err)
+		}
+
+		for _, s := range sessions {
+			result, err := splitSession(u, s, &last, *dryRun)
+			if err != nil {
+				return fmt.Errorf("user %s session %s: %w", u, s, err)
+			}
+			if len(result.Sessions) < 2 {
+				continue
+			}
+			fmt.Printf("User %s: %d points of session %s %s into session(s) %v\n", u, result.Points, s, verb, result.Sessions)
+		}
+	}
+	return nil
+}
+
+// flagSet reports whether a flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Device is a tracker allowed to send the points of one user. Only the hash
+// of its token is stored, the token itself is shown once when it is created.
+type Device struct {
+	ID        int64  `json:"id"`
+	User      string `json:"user"`
+	Name      string `json:"name"`
+	TokenHash string `json:"-"`
+	CreatedAt int64  `json:"created_at"`           // Unix milliseconds
+	RevokedAt int64  `json:"revoked_at,omitempty"` // Unix milliseconds, 0 while active
+}
+
+// newDevice is the answer to a device creation, the only one with the token.
+type newDevice struct {
+	Device
+	Token string `json:"token"`
+}
+
+// errInvalidDeviceUser refuses a device for a user that is not a number.
+var errInvalidDeviceUser = errors.New("invalid user parameter")
+
+// createDevice registers a device for a user and returns it with its token.
+func createDevice(user, name string) (newDevice, error) {
+	if user == "" || !isNumeric(user) || len(user) > AppConfig.MaxGetParmLen {
+		return newDevice{}, errInvalidDeviceUser
+	}
+	token, err := newToken()
+	if err != nil {
+		return newDevice{}, err
+	}
+
+	d := Device{User: user, Name: name, TokenHash: hashKey(token), CreatedAt: time.Now().UnixMilli()}
+	d.ID, err = store.AddDevice(d)
+	if err != nil {
+		return newDevice{}, err
+	}
+	return newDevice{Device: d, Token: token}, nil
+}
+
+// getDevices lists every device, revoked ones included.
+func getDevices(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	devices, err := store.Devices()
+	if err != nil {
+		requestLogger(r).Error("Device query error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// postDevice creates a device for the user and name parameters. The answer
+// holds the token, which cannot be retrieved afterwards.
+func postDevice(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	device, err := createDevice(r.FormValue("user"), r.FormValue("name"))
+	if errors.Is(err, errInvalidDeviceUser) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Device creation error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(device)
+}
+
+// deleteDevice revokes a device, its token is refused from then on.
+func deleteDevice(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid device id", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := store.RevokeDevice(id, time.Now().UnixMilli())
+	if err != nil {
+		requestLogger(r).Error("Device revoke error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
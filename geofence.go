@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Geofence shapes
+const (
+	geofenceCircle  = "circle"
+	geofencePolygon = "polygon"
+)
+
+// Geofence transitions
+const (
+	geofenceEnter = "enter"
+	geofenceExit  = "exit"
+)
+
+// earthRadius is the mean Earth radius in meters, as used by the map.
+const earthRadius = 6371e3
+
+// Geofence is an area watched for the arrival and departure of a user, or of
+// every user when User is empty. A circle is given by its center and radius
+// in meters, a polygon by its [lat, lon] vertices.
+type Geofence struct {
+	ID        int64        `json:"id"`
+	User      string       `json:"user,omitempty"`
+	Name      string       `json:"name"`
+	Type      string       `json:"type"`
+	Lat       float64      `json:"lat,omitempty"`
+	Lon       float64      `json:"lon,omitempty"`
+	Radius    float64      `json:"radius,omitempty"`
+	Polygon   [][2]float64 `json:"polygon,omitempty"`
+	CreatedAt int64        `json:"created_at"` // Unix milliseconds
+}
+
+// GeofenceEvent records a user entering or leaving a geofence.
+type GeofenceEvent struct {
+	ID         int64   `json:"id"`
+	GeofenceID int64   `json:"geofence_id"`
+	Geofence   string  `json:"geofence"`
+	User       string  `json:"user"`
+	Session    string  `json:"session"`
+	Type       string  `json:"type"`
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+	Time       int64   `json:"timestamp"` // Unix milliseconds
+}
+
+// validate checks a geofence sent by a client.
+func (g *Geofence) validate() error {
+	if g.Name == "" {
+		return errors.New("name is required")
+	}
+	if g.User != "" && (!isNumeric(g.User) || len(g.User) > AppConfig.MaxGetParmLen) {
+		return errors.New("invalid user")
+	}
+	switch g.Type {
+	case geofenceCircle:
+		if !validLatLon(g.Lat, g.Lon) {
+			return errors.New("invalid center")
+		}
+		if g.Radius <= 0 {
+			return errors.New("radius must be positive")
+		}
+		g.Polygon = nil
+	case geofencePolygon:
+		if len(g.Polygon) < 3 {
+			return errors.New("a polygon needs at least 3 vertices")
+		}
+		for _, v := range g.Polygon {
+			if !validLatLon(v[0], v[1]) {
+				return fmt.Errorf("invalid vertex %v", v)
+			}
+		}
+		g.Lat, g.Lon, g.Radius = 0, 0, 0
+	default:
+		return fmt.Errorf("type must be %q or %q", geofenceCircle, geofencePolygon)
+	}
+	return nil
+}
+
+func validLatLon(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// appliesTo reports whether the geofence watches the user.
+func (g *Geofence) appliesTo(user string) bool {
+	return g.User == "" || g.User == user
+}
+
+// contains reports whether a position is inside the geofence.
+func (g *Geofence) contains(lat, lon float64) bool {
+	if g.Type == geofenceCircle {
+		return haversine(g.Lat, g.Lon, lat, lon) <= g.Radius
+	}
+	return pointInPolygon(lat, lon, g.Polygon)
+}
+
+// haversine returns the great-circle distance in meters between two positions.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	φ1 := lat1 * math.Pi / 180
+	φ2 := lat2 * math.Pi / 180
+	Δφ := (lat2 - lat1) * math.Pi / 180
+	Δλ := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(Δφ/2)*math.Sin(Δφ/2) + math.Cos(φ1)*math.Cos(φ2)*math.Sin(Δλ/2)*math.Sin(Δλ/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// pointInPolygon casts a ray from the position and counts the crossed edges,
+// treating latitude and longitude as plane coordinates, which is accurate
+// enough for areas the size of a site. A position on the south or west edge
+// is inside and one on the north or east edge is not, so adjacent polygons
+// never both contain it.
+func pointInPolygon(lat, lon float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		yi, xi := polygon[i][0], polygon[i][1]
+		yj, xj := polygon[j][0], polygon[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geofenceKey identifies the state of a user for a geofence.
+type geofenceKey struct {
+	id   int64
+	user string
+}
+
+// geofenceMonitor detects the transitions of the stored points. Geofences are
+// cached until they change, and whether a user is inside one is taken from
+// the last recorded event, so the state survives a restart. mu only guards
+// the cache; the points of a user are checked one at a time under the lock of
+// the user, so the points of other users do not wait for the store.
+type geofenceMonitor struct {
+	mu        sync.Mutex
+	gen       int // incremented by invalidate
+	loaded    bool
+	geofences []Geofence
+	inside    map[geofenceKey]bool
+	users     map[string]*sync.Mutex
+}
+
+var geofences = &geofenceMonitor{inside: make(map[geofenceKey]bool), users: make(map[string]*sync.Mutex)}
+
+// invalidate drops the cache after a geofence was changed.
+func (m *geofenceMonitor) invalidate() {
+	m.mu.Lock()
+	m.gen++
+	m.loaded = false
+	m.geofences = nil
+	m.inside = make(map[geofenceKey]bool)
+	m.mu.Unlock()
+}
+
+// load returns the geofences and the generation of the cache, reading them
+// from the store when they are not cached.
+func (m *geofenceMonitor) load() ([]Geofence, int, error) {
+	m.mu.Lock()
+	loaded, list, gen := m.loaded, m.geofences, m.gen
+	m.mu.Unlock()
+	if loaded {
+		return list, gen, nil
+	}
+
+	all, err := store.Geofences()
+	if err != nil {
+		return nil, 0, err
+	}
+	m.mu.Lock()
+	if m.gen == gen {
+		m.geofences, m.loaded = all, true
+	}
+	m.mu.Unlock()
+	return all, gen, nil
+}
+
+// userLock returns the lock serializing the checks of a user.
+func (m *geofenceMonitor) userLock(user string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock, ok := m.users[user]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.users[user] = lock
+	}
+	return lock
+}
+
+// state returns whether a user is inside a geofence, if known.
+func (m *geofenceMonitor) state(key geofenceKey) (inside, known bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inside, known = m.inside[key]
+	return inside, known
+}
+
+// setState records whether a user is inside a geofence, unless the cache was
+// invalidated since gen.
+func (m *geofenceMonitor) setState(key geofenceKey, gen int, inside bool) {
+	m.mu.Lock()
+	if m.gen == gen {
+		m.inside[key] = inside
+	}
+	m.mu.Unlock()
+}
+
+// check evaluates a stored point against the geofences of its user and
+// records the transitions, which are returned.
+func (m *geofenceMonitor) check(p Point) ([]GeofenceEvent, error) {
+	list, gen, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	lock := m.userLock(p.User)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var events []GeofenceEvent
+	for _, g := range list {
+		if !g.appliesTo(p.User) {
+			continue
+		}
+		key := geofenceKey{g.ID, p.User}
+		was, known := m.state(key)
+		if !known {
+			last, err := store.LastGeofenceEvent(g.ID, p.User)
+			if err != nil {
+				return events, err
+			}
+			was = last == geofenceEnter
+		}
+
+		now := g.contains(p.Lat, p.Lon)
+		if now == was {
+			m.setState(key, gen, now)
+			continue
+		}
+
+		ev := GeofenceEvent{
+			GeofenceID: g.ID,
+			Geofence:   g.Name,
+			User:       p.User,
+			Session:    p.Session,
+			Type:       geofenceExit,
+			Lat:        p.Lat,
+			Lon:        p.Lon,
+			Time:       p.Time,
+		}
+		if now {
+			ev.Type = geofenceEnter
+		}
+		if ev.Time == 0 {
+			ev.Time = time.Now().UnixMilli()
+		}
+		id, err := store.AddGeofenceEvent(ev)
+		if err != nil {
+			return events, err
+		}
+		ev.ID = id
+		m.setState(key, gen, now)
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// mayViewGeofences reports whether the key of a request may see the
+// geofences of the map of users, every user when nil: the shared or admin
+// key, or a device token of the only user shown.
+func mayViewGeofences(r *http.Request, users []string) bool {
+	key := requestKey(r)
+	if key == "" {
+		return false
+	}
+	cred, err := authenticate(key)
+	if err != nil {
+		return false
+	}
+	if cred.Device == nil {
+		return true
+	}
+	return len(users) == 1 && users[0] == cred.Device.User
+}
+
+// geofencesForUser returns the geofences watching a user, or all of them
+// when user is empty.
+func geofencesForUser(user string) ([]Geofence, error) {
+	all, err := store.Geofences()
+	if err != nil {
+		return nil, err
+	}
+	if user == "" {
+		return all, nil
+	}
+	result := make([]Geofence, 0, len(all))
+	for _, g := range all {
+		if g.appliesTo(user) {
+			result = append(result, g)
+		}
+	}
+	return result, nil
+}
+
+// sendGeofenceEvent sends a transition to an SSE client.
+func sendGeofenceEvent(w http.ResponseWriter, ev *GeofenceEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Error marshaling JSON", "error", err)
+		return
+	}
+	fmt.Fprintf(w, "event: geofence\ndata: %s\n\n", data)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// getGeofences lists the geofences, only those watching the user parameter
+// when it is given.
+func getGeofences(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	list, err := geofencesForUser(r.URL.Query().Get("user"))
+	if err != nil {
+		requestLogger(r).Error("Geofence query error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// postGeofence creates a geofence from a JSON body.
+func postGeofence(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	g, ok := readGeofence(w, r)
+	if !ok {
+		return
+	}
+	g.CreatedAt = time.Now().UnixMilli()
+
+	id, err := store.AddGeofence(g)
+	if err != nil {
+		requestLogger(r).Error("Geofence insert error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	g.ID = id
+	geofences.invalidate()
+	writeJSON(w, http.StatusCreated, g)
+}
+
+// putGeofence replaces a geofence with a JSON body.
+func putGeofence(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid geofence id", http.StatusBadRequest)
+		return
+	}
+	g, ok := readGeofence(w, r)
+	if !ok {
+		return
+	}
+	g.ID = id
+
+	updated, err := store.UpdateGeofence(g)
+	if err != nil {
+		requestLogger(r).Error("Geofence update error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.NotFound(w, r)
+		return
+	}
+	geofences.invalidate()
+
+	// Answer with the stored geofence, which keeps its creation time.
+	list, err := store.Geofences()
+	if err != nil {
+		requestLogger(r).Error("Geofence query error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, stored := range list {
+		if stored.ID == id {
+			g = stored
+		}
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+// deleteGeofence removes a geofence, its recorded events are kept.
+func deleteGeofence(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid geofence id", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := store.DeleteGeofence(id)
+	if err != nil {
+		requestLogger(r).Error("Geofence delete error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.NotFound(w, r)
+		return
+	}
+	geofences.invalidate()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getGeofenceEvents lists the newest transitions, optionally of one user.
+// The number is set with limit, 100 by default.
+func getGeofenceEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if !checkParam(user, AppConfig.MaxGetParmLen) {
+		http.Error(w, "Invalid user parameter", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, err := store.GeofenceEvents(user, limit)
+	if err != nil {
+		requestLogger(r).Error("Geofence event query error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// readGeofence decodes and validates the geofence of a request body,
+// answering the request when it is invalid.
+func readGeofence(w http.ResponseWriter, r *http.Request) (Geofence, bool) {
+	var g Geofence
+	r.Body = http.MaxBytesReader(w, r.Body, maxPointBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return g, false
+	}
+	if err := g.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return g, false
+	}
+	return g, true
+}
+
+// writeJSON answers a request with a JSON value.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPointInPolygon(t *testing.T) {
+	// [lat, lon] vertices
+	square := [][2]float64{{0, 0}, {0, 10}, {10, 10}, {10, 0}}
+	// A U opening to the north, its notch is between longitudes 3 and 7
+	concave := [][2]float64{{0, 0}, {0, 10}, {10, 10}, {10, 7}, {3, 7}, {3, 3}, {10, 3}, {10, 0}}
+
+	for _, tc := range []struct {
+		name     string
+		polygon  [][2]float64
+		lat, lon float64
+		want     bool
+	}{
+		{"inside", square, 5, 5, true},
+		{"outside", square, 5, 15, false},
+		{"outside below", square, -1, 5, false},
+		{"on the west edge", square, 5, 0, true},
+		{"on the south edge", square, 0, 5, true},
+		{"on the east edge", square, 5, 10, false},
+		{"on the north edge", square, 10, 5, false},
+		{"concave base", concave, 1, 5, true},
+		{"concave west arm", concave, 8, 1, true},
+		{"concave east arm", concave, 8, 9, true},
+		{"concave notch", concave, 8, 5, false},
+		{"concave outside", concave, 11, 5, false},
+	} {
+		if got := pointInPolygon(tc.lat, tc.lon, tc.polygon); got != tc.want {
+			t.Errorf("%s: pointInPolygon(%v, %v) = %v, want %v", tc.name, tc.lat, tc.lon, got, tc.want)
+		}
+	}
+}
+
+func TestGeofenceMonitorTransitions(t *testing.T) {
+	useTestStore(t)
+	_, err := store.AddGeofence(Geofence{Name: "home", Type: geofencePolygon, Polygon: [][2]float64{{0, 0}, {0, 10}, {10, 10}, {10, 0}}, CreatedAt: 1})
+	must(t, err)
+	m := &geofenceMonitor{inside: make(map[geofenceKey]bool), users: make(map[string]*sync.Mutex)}
+
+	var got []string
+	for i, pos := range [][2]float64{{-5, 5}, {-1, 5}, {2, 5}, {5, 5}, {8, 5}, {12, 5}, {15, 5}} {
+		events, err := m.check(Point{User: "1", Session: "2", Lat: pos[0], Lon: pos[1], Time: int64(i + 1)})
+		must(t, err)
+		for _, ev := range events {
+			got = append(got, ev.Type)
+		}
+	}
+	if len(got) != 2 || got[0] != geofenceEnter || got[1] != geofenceExit {
+		t.Errorf("events = %v, want [enter exit]", got)
+	}
+
+	recorded, err := store.GeofenceEvents("1", 10)
+	must(t, err)
+	if len(recorded) != 2 {
+		t.Errorf("recorded events = %d, want 2", len(recorded))
+	}
+}
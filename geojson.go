@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string         `json:"type"`
+	Geometry   Geometry       `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type Geometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+func newFeatureCollection() FeatureCollection {
+	return FeatureCollection{Type: "FeatureCollection", Features: []Feature{}}
+}
+
+// getGeoJSONTrack returns the points of the map as GeoJSON: one LineString per
+// user and, with points=true, a Point feature for every point. It takes the
+// same user, session, maxshowpoint and share parameters as the map.
+func getGeoJSONTrack(w http.ResponseWriter, r *http.Request) {
+	// A long track takes more than the write timeout of the server to send
+	w = streamWriter{w, http.NewResponseController(w)}
+
+	user := r.URL.Query().Get("user")
+	session := r.URL.Query().Get("session")
+	maxshowpoint := r.URL.Query().Get("maxshowpoint")
+	withPoints := r.URL.Query().Get("points") == "true"
+
+	share, err := requestShare(r)
+	if err != nil {
+		writeShareError(w, r, err)
+		return
+	}
+
+	if share == nil && AppConfig.ShowMapOnlyWithUser && user == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !isValidParam(user, AppConfig.MaxGetParmLen) || !isValidParam(session, AppConfig.MaxGetParmLen) || (!AppConfig.AllowBypassMaxShowPoint && !isValidParam(maxshowpoint, AppConfig.MaxGetParmLen)) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var points []Point
+	if share == nil {
+		points, err = fetchPointsFromDB(PointQuery{User: user, Session: session}, maxshowpoint)
+	} else if !share.LiveOnly {
+		points, err = fetchPointsFromDB(share.pointQuery(), maxshowpoint)
+	}
+	if err != nil {
+		requestLogger(r).Error("Error querying database", "error", err)
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+
+	fc := newFeatureCollection()
+	byUser := make(map[string][][]float64)
+	var order []string
+	for _, p := range points {
+		coord := []float64{p.Lon, p.Lat, p.Alt}
+		if _, ok := byUser[p.User]; !ok {
+			order = append(order, p.User)
+		}
+		byUser[p.User] = append(byUser[p.User], coord)
+		if withPoints {
+			fc.Features = append(fc.Features, Feature{
+				Type:       "Feature",
+				Geometry:   Geometry{Type: "Point", Coordinates: coord},
+				Properties: pointProperties(p.LatLng()),
+			})
+		}
+	}
+
+	lines := make([]Feature, 0, len(order))
+	for _, u := range order {
+		// A LineString needs at least two positions
+		if len(byUser[u]) < 2 {
+			continue
+		}
+		lines = append(lines, Feature{
+			Type:     "Feature",
+			Geometry: Geometry{Type: "LineString", Coordinates: byUser[u]},
+			Properties: map[string]any{
+				"user":    u,
+				"session": session,
+				"color":   userColor(u),
+			},
+		})
+	}
+	fc.Features = append(lines, fc.Features...)
+
+	writeGeoJSON(w, r, fc)
+}
+
+// getGeoJSONLast returns the last known position of every user, or of the
+// given user, as Point features, optionally restricted to a session.
+func getGeoJSONLast(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	session := r.URL.Query().Get("session")
+
+	share, err := requestShare(r)
+	if err != nil {
+		writeShareError(w, r, err)
+		return
+	}
+
+	if share == nil && AppConfig.ShowMapOnlyWithUser && user == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !isValidParam(user, AppConfig.MaxGetParmLen) || !isValidParam(session, AppConfig.MaxGetParmLen) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if session == "" {
+		session = "0"
+	}
+	if share != nil {
+		user, session = share.User, share.eventSession()
+	}
+
+	var positions []*LatLng
+	if user == "" {
+		positions, err = getLastKnownPositions(session)
+	} else {
+		var p *LatLng
+		p, err = getLastKnownPosition(user, session)
+		if p != nil {
+			positions = append(positions, p)
+		}
+	}
+	if err != nil {
+		requestLogger(r).Error("Error querying database", "error", err)
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+
+	fc := newFeatureCollection()
+	for _, p := range positions {
+		if share != nil && !share.allows(p.Timestamp) {
+			continue
+		}
+		fc.Features = append(fc.Features, Feature{
+			Type:       "Feature",
+			Geometry:   Geometry{Type: "Point", Coordinates: []float64{parseFloat(p.Lng), parseFloat(p.Lat), parseFloat(p.Alt)}},
+			Properties: pointProperties(p),
+		})
+	}
+
+	writeGeoJSON(w, r, fc)
+}
+
+// pointProperties returns the telemetry of a point as GeoJSON properties.
+func pointProperties(p *LatLng) map[string]any {
+	props := map[string]any{
+		"user":    p.User,
+		"session": p.Session,
+		"color":   p.Color,
+		"alt":     parseFloat(p.Alt),
+		"speed":   parseFloat(p.Speed),
+		"bearing": parseFloat(p.Bear),
+		"hdop":    parseFloat(p.Hdop),
+		"acc":     parseFloat(p.Acc),
+		"time":    nil,
+	}
+	if p.Timestamp != 0 {
+		props["time"] = time.UnixMilli(p.Timestamp).UTC().Format(time.RFC3339)
+	}
+	return props
+}
+
+func writeGeoJSON(w http.ResponseWriter, r *http.Request, fc FeatureCollection) {
+	w.Header().Set("Content-Type", "application/geo+json")
+	if err := json.NewEncoder(w).Encode(fc); err != nil {
+		requestLogger(r).Error("Error writing GeoJSON", "error", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// maxGpxUploadSize limits the size of an uploaded GPX file.
+const maxGpxUploadSize = 64 << 20
+
+// How an imported GPX file is split into sessions
+const (
+	gpxSplitNone    = ""
+	gpxSplitTrack   = "trk"
+	gpxSplitSegment = "trkseg"
+)
+
+// errInvalidImport is returned by importGpx for invalid parameters.
+var errInvalidImport = errors.New("invalid import")
+
+type gpxImportResult struct {
+	Sessions   []string `json:"sessions"`
+	Imported   int      `json:"imported"`
+	Duplicates int      `json:"duplicates"`
+	Rejected   int      `json:"rejected"`
+}
+
+// parseGpx decodes a GPX 1.0 or 1.1 document.
+func parseGpx(r io.Reader) (GPX, error) {
+	var gpx GPX
+	if err := xml.NewDecoder(r).Decode(&gpx); err != nil {
+		return GPX{}, fmt.Errorf("invalid GPX file: %w", err)
+	}
+	return gpx, nil
+}
+
+// importGpx stores the points of a GPX document for a user. With split set to
+// "trk" or "trkseg" every track or track segment gets its own session,
+// numbered upwards from session; otherwise every point goes into session.
+// An empty session means the first session number not used by the user yet.
+// Imported points are history, so they are not pushed to the live viewers.
+func importGpx(gpx GPX, user, session, split string) (gpxImportResult, error) {
+	var result gpxImportResult
+	if split != gpxSplitNone && split != gpxSplitTrack && split != gpxSplitSegment {
+		return result, fmt.Errorf("%w: split must be %q or %q", errInvalidImport, gpxSplitTrack, gpxSplitSegment)
+	}
+	if !isNumeric(user) || len(user) > AppConfig.MaxGetParmLen {
+		return result, fmt.Errorf("%w: invalid user parameter", errInvalidImport)
+	}
+
+	var next int64
+	if session == "" {
+		max, err := store.MaxSession(user)
+		if err != nil {
+			return result, err
+		}
+		next = max + 1
+	} else {
+		n, err := strconv.ParseInt(session, 10, 64)
+		if err != nil || len(session) > AppConfig.MaxGetParmLen {
+			return result, fmt.Errorf("%w: invalid session parameter", errInvalidImport)
+		}
+		next = n
+	}
+
+	var points []Point
+	current := strconv.FormatInt(next, 10)
+	result.Sessions = []string{current}
+	newSession := func() {
+		if len(points) == 0 && len(result.Sessions) == 1 {
+			return // nothing stored in the first session yet
+		}
+		next++
+		current = strconv.FormatInt(next, 10)
+		result.Sessions = append(result.Sessions, current)
+	}
+
+	for ti, track := range gpx.Tracks {
+		if split == gpxSplitTrack && ti > 0 {
+			newSession()
+		}
+		for si, segment := range track.Segments {
+			if split == gpxSplitSegment && (ti > 0 || si > 0) {
+				newSession()
+			}
+			for _, gp := range segment.Points {
+				point, err := validatePoint(gp.params(user, current))
+				if err != nil {
+					result.Rejected++
+					continue
+				}
+				points = append(points, point)
+			}
+		}
+	}
+
+	inserted, err := store.InsertPoints(points)
+	if err != nil {
+		return result, err
+	}
+	for i, ok := range inserted {
+		if ok {
+			result.Imported++
+			sessionStats.invalidate(points[i].User, points[i].Session)
+			liveSessions.forget(points[i].User)
+		} else {
+			result.Duplicates++
+		}
+	}
+	return result, nil
+}
+
+// params converts a GPX point into the values sent by a tracker.
+func (p GPXPoint) params(user, session string) pointParams {
+	speed, course := p.Speed, p.Course
+	if ext := p.Extensions; ext != nil {
+		if ext.Speed != 0 {
+			speed = ext.Speed
+		}
+		if ext.Course != 0 {
+			course = ext.Course
+		}
+		if tpx := ext.TrackPointExtension; tpx != nil {
+			if tpx.Speed != 0 {
+				speed = tpx.Speed
+			}
+			if tpx.Course != 0 {
+				course = tpx.Course
+			}
+		}
+	}
+	return pointParams{
+		Lat:       formatCoordinate(p.Latitude),
+		Lon:       formatCoordinate(p.Longitude),
+		Timestamp: normalizeTimestamp(p.Time),
+		Altitude:  strconv.FormatFloat(p.Elevation, 'f', -1, 64),
+		Speed:     strconv.FormatFloat(speed, 'f', -1, 64),
+		Bearing:   strconv.FormatFloat(course, 'f', -1, 64),
+		Hdop:      strconv.FormatFloat(p.Hdop, 'f', -1, 64),
+		User:      user,
+		Session:   session,
+	}
+}
+
+// formatCoordinate rounds a coordinate to 8 decimals (about a millimeter),
+// so it fits within MaxGetParmLen.
+func formatCoordinate(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1e8)/1e8, 'f', -1, 64)
+}
+
+// postGpxImport imports an uploaded GPX file, sent either as the "file" field
+// of a multipart form or as the request body.
+func postGpxImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	user, err := authorizeUser(requestKey(r), query.Get("user"))
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+
+	// A large file takes more than the timeouts of the server to upload and
+	// import
+	rc := http.NewResponseController(w)
+	w = streamWriter{w, rc}
+	r.Body = http.MaxBytesReader(w, streamReader{r.Body, rc}, maxGpxUploadSize)
+	var body io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	gpx, err := parseGpx(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := importGpx(gpx, user, query.Get("session"), query.Get("split"))
+	if errors.Is(err, errInvalidImport) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		requestLogger(r).Error("GPX import error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,115 @@
+package main
+
+import "sync"
+
+// subscriberBuffer is the number of pending updates kept for a slow SSE client
+// before the oldest ones are dropped.
+const subscriberBuffer = 16
+
+// Hub fans out every accepted point to the SSE clients interested in it.
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscriber]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// Subscriber receives the points and geofence events published for a set of
+// users and a session. A nil Users set matches every user, a session of "0"
+// matches every session.
+type Subscriber struct {
+	Users     map[string]bool
+	Session   string
+	C         chan *LatLng
+	Geofences chan *GeofenceEvent
+}
+
+var liveHub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[*Subscriber]struct{}), done: make(chan struct{})}
+}
+
+// Close tells the SSE streams to end, when the server shuts down. It is safe
+// to call more than once.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// Done is closed by Close.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Subscribe registers a new subscriber for the given users and session.
+// Passing no users subscribes to every user.
+func (h *Hub) Subscribe(users []string, session string) *Subscriber {
+	s := &Subscriber{
+		Session:   session,
+		C:         make(chan *LatLng, subscriberBuffer),
+		Geofences: make(chan *GeofenceEvent, subscriberBuffer),
+	}
+	if len(users) > 0 {
+		s.Users = make(map[string]bool, len(users))
+		for _, user := range users {
+			s.Users[user] = true
+		}
+	}
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Unsubscribe removes a subscriber. It is safe to call more than once.
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, s)
+	h.mu.Unlock()
+}
+
+// Publish delivers a point to every matching subscriber without blocking.
+// If a subscriber is not keeping up, its oldest pending point is discarded.
+func (h *Hub) Publish(point *LatLng) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subscribers {
+		if s.matches(point.User, point.Session) {
+			deliver(s.C, point)
+		}
+	}
+}
+
+// PublishGeofence delivers a geofence event like Publish delivers a point.
+func (h *Hub) PublishGeofence(ev *GeofenceEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subscribers {
+		if s.matches(ev.User, ev.Session) {
+			deliver(s.Geofences, ev)
+		}
+	}
+}
+
+// deliver sends a value without blocking, discarding the oldest pending one
+// when the channel is full.
+func deliver[T any](c chan T, v T) {
+	for {
+		select {
+		case c <- v:
+			return
+		default:
+			select {
+			case <-c:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Subscriber) matches(user, session string) bool {
+	if s.Users != nil && !s.Users[user] {
+		return false
+	}
+	return s.Session == "0" || s.Session == session
+}
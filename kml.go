@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// KML document with a gx:Track, a LineString fallback and the last position.
+// encoding/xml has no namespace prefixes, so the gx elements are written with
+// their prefixed names and the namespace is declared on the root element.
+type KML struct {
+	XMLName  xml.Name    `xml:"kml"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	XmlnsGx  string      `xml:"xmlns:gx,attr"`
+	Document KMLDocument `xml:"Document"`
+}
+
+type KMLDocument struct {
+	Name       string         `xml:"name"`
+	Styles     []KMLStyle     `xml:"Style"`
+	Placemarks []KMLPlacemark `xml:"Placemark"`
+}
+
+type KMLStyle struct {
+	ID        string        `xml:"id,attr"`
+	LineStyle *KMLLineStyle `xml:"LineStyle,omitempty"`
+	IconStyle *KMLIconStyle `xml:"IconStyle,omitempty"`
+}
+
+type KMLLineStyle struct {
+	Color string `xml:"color"`
+	Width int    `xml:"width"`
+}
+
+type KMLIconStyle struct {
+	Color string `xml:"color"`
+}
+
+type KMLPlacemark struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	StyleURL    string         `xml:"styleUrl"`
+	Track       *KMLTrack      `xml:"gx:Track,omitempty"`
+	LineString  *KMLLineString `xml:"LineString,omitempty"`
+	Point       *KMLPoint      `xml:"Point,omitempty"`
+}
+
+type KMLTrack struct {
+	AltitudeMode string   `xml:"altitudeMode"`
+	When         []string `xml:"when"`
+	Coords       []string `xml:"gx:coord"`
+}
+
+type KMLLineString struct {
+	Tessellate   int    `xml:"tessellate"`
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+type KMLPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// getKmlTrack exports a user/session as KML, or as KMZ with format=kmz or on
+// the /download-kmz path.
+func getKmlTrack(w http.ResponseWriter, r *http.Request) {
+	// A long track takes more than the write timeout of the server to send
+	w = streamWriter{w, http.NewResponseController(w)}
+
+	// Validate key, user, and session parameters
+	user, err := validateRequestParameters(r)
+	if err != nil {
+		writeExportError(w, r, err)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		session = "0"
+	}
+
+	points, err := fetchGpsTrack(user, session)
+	if err != nil {
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+
+	kml := createKmlStructure(user, session, points)
+	if r.URL.Path == "/download-kmz" || r.URL.Query().Get("format") == "kmz" {
+		writeKmzResponse(w, kml)
+		return
+	}
+	writeKmlResponse(w, kml)
+}
+
+func createKmlStructure(user, session string, points []GPXPoint) KML {
+	color := kmlColor(userColor(user))
+	doc := KMLDocument{
+		Name: fmt.Sprintf("GoLiveTracking user %s session %s", user, session),
+		Styles: []KMLStyle{
+			{ID: "track", LineStyle: &KMLLineStyle{Color: color, Width: 4}, IconStyle: &KMLIconStyle{Color: color}},
+			{ID: "last", IconStyle: &KMLIconStyle{Color: color}},
+		},
+	}
+
+	track := &KMLTrack{AltitudeMode: "absolute"}
+	coordinates := make([]string, 0, len(points))
+	for _, p := range points {
+		lon := strconv.FormatFloat(p.Longitude, 'f', -1, 64)
+		lat := strconv.FormatFloat(p.Latitude, 'f', -1, 64)
+		alt := strconv.FormatFloat(p.Elevation, 'f', -1, 64)
+		coordinates = append(coordinates, lon+","+lat+","+alt)
+		// gx:Track needs a time for every coordinate
+		if p.Time != "" {
+			track.When = append(track.When, p.Time)
+			track.Coords = append(track.Coords, lon+" "+lat+" "+alt)
+		}
+	}
+
+	if len(track.When) > 0 {
+		doc.Placemarks = append(doc.Placemarks, KMLPlacemark{Name: "Track", StyleURL: "#track", Track: track})
+	}
+	if len(coordinates) > 0 {
+		doc.Placemarks = append(doc.Placemarks, KMLPlacemark{
+			Name:       "Path",
+			StyleURL:   "#track",
+			LineString: &KMLLineString{Tessellate: 1, AltitudeMode: "clampToGround", Coordinates: strings.Join(coordinates, " ")},
+		})
+
+		doc.Placemarks = append(doc.Placemarks, KMLPlacemark{
+			Name:        "Last position",
+			Description: points[len(points)-1].Time,
+			StyleURL:    "#last",
+			Point:       &KMLPoint{Coordinates: coordinates[len(coordinates)-1]},
+		})
+	}
+
+	return KML{
+		Xmlns:    "http://www.opengis.net/kml/2.2",
+		XmlnsGx:  "http://www.google.com/kml/ext/2.2",
+		Document: doc,
+	}
+}
+
+// kmlColor converts a #rrggbb color into the aabbggrr notation of KML.
+func kmlColor(hex string) string {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return "ff0000ff"
+	}
+	return "ff" + hex[4:6] + hex[2:4] + hex[0:2]
+}
+
+func encodeKml(w io.Writer, kml KML) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "    ")
+	return enc.Encode(kml)
+}
+
+func writeKmlResponse(w http.ResponseWriter, kml KML) {
+	w.Header().Set("Content-Disposition", "attachment; filename=my_gps_track.kml")
+	w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+
+	if err := encodeKml(w, kml); err != nil {
+		http.Error(w, "Error writing KML file", http.StatusInternalServerError)
+	}
+}
+
+// writeKmzResponse writes the KML zipped as doc.kml, the name Google Earth expects.
+func writeKmzResponse(w http.ResponseWriter, kml KML) {
+	w.Header().Set("Content-Disposition", "attachment; filename=my_gps_track.kmz")
+	w.Header().Set("Content-Type", "application/vnd.google-earth.kmz")
+
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("doc.kml")
+	if err == nil {
+		err = encodeKml(f, kml)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		http.Error(w, "Error writing KMZ file", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// requestIDHeader carries the ID of a request, taken from the client or a
+// proxy when it sends a usable one.
+const requestIDHeader = "X-Request-ID"
+
+var safeRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// setupLogging installs the logger configured by LogLevel and LogFormat as
+// the default one, which the log package also writes to. ConsoleDebug is
+// the debug level of older configurations.
+func setupLogging(cfg Cfg) error {
+	var level slog.Level
+	switch strings.ToLower(cfg.LogLevel) {
+	case "":
+		if cfg.ConsoleDebug {
+			level = slog.LevelDebug
+		}
+	case "debug":
+		level = slog.LevelDebug
+	case "info":
+		level = slog.LevelInfo
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return fmt.Errorf("LogLevel must be debug, info, warn or error, not %q", cfg.LogLevel)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.LogFormat) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("LogFormat must be text or json, not %q", cfg.LogFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+type loggerKey struct{}
+
+// withRequestID gives every request an ID, returned in X-Request-ID, and a
+// logger that adds it to the records.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !safeRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		logger := slog.Default().With("request_id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns the logger of a request, the default one outside of
+// withRequestID.
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	pointsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "golivetracking_points_accepted_total",
+		Help: "Points received live and stored.",
+	})
+	pointsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "golivetracking_points_rejected_total",
+		Help: "Points refused, by reason.",
+	}, []string{"reason"})
+	sseConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "golivetracking_sse_connections",
+		Help: "Open SSE streams.",
+	})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "golivetracking_db_query_duration_seconds",
+		Help:    "Execution time of the prepared statements.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9), // 100µs to 6.5s
+	}, []string{"statement"})
+	gpxExportBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "golivetracking_gpx_export_bytes",
+		Help:    "Size of the GPX files downloaded.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 9), // 1KiB to 64MiB
+	})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "golivetracking_http_request_duration_seconds",
+		Help:    "Duration of the HTTP requests, by route. SSE streams last until the client leaves.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+)
+
+// Rejection reasons of the points that are not about a single value
+const (
+	rejectBadRequest   = "bad_request"
+	rejectBodyTooLarge = "body_too_large"
+	rejectUnauthorized = "unauthorized"
+	rejectForbidden    = "forbidden"
+	rejectStoreError   = "store_error"
+)
+
+// timedStmt is a prepared statement whose executions are observed by
+// dbQueryDuration. Query is timed until the first row is available.
+type timedStmt struct {
+	*sql.Stmt
+	name string
+}
+
+func (s *timedStmt) Exec(args ...any) (sql.Result, error) {
+	defer s.observe(time.Now())
+	return s.Stmt.Exec(args...)
+}
+
+func (s *timedStmt) Query(args ...any) (*sql.Rows, error) {
+	defer s.observe(time.Now())
+	return s.Stmt.Query(args...)
+}
+
+func (s *timedStmt) QueryRow(args ...any) *sql.Row {
+	defer s.observe(time.Now())
+	return s.Stmt.QueryRow(args...)
+}
+
+// in returns the statement bound to a transaction.
+func (s *timedStmt) in(tx *sql.Tx) *timedStmt {
+	return &timedStmt{tx.Stmt(s.Stmt), s.name}
+}
+
+func (s *timedStmt) observe(start time.Time) {
+	dbQueryDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+}
+
+// instrumentRoutes observes the duration of the requests, labeled with the
+// pattern of the route of the mux serving them.
+func instrumentRoutes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		start := time.Now()
+		mux.ServeHTTP(w, r)
+		httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsHandler serves the metrics in the Prometheus format. When
+// MetricsToken is set, it must be sent as a bearer token or key parameter.
+func metricsHandler() http.Handler {
+	metrics := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if AppConfig.MetricsToken != "" && subtle.ConstantTimeCompare([]byte(requestKey(r)), []byte(AppConfig.MetricsToken)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
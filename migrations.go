@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqliteMigrations lists every schema change of the SQLite store. Only append
+// to it, never reorder or edit a migration that has been released.
+var sqliteMigrations = []migration{
+	{1, "typed points table", migrateTypedPoints},
+	{2, "devices table", migrateDevices},
+	{3, "shares table", migrateShares},
+	{4, "geofences and geofence events", migrateGeofences},
+	{5, "webhook delivery queue", migrateWebhookDeliveries},
+}
+
+// migrateTypedPoints creates the Points table with typed columns. Databases
+// created by older versions, where every column was a STRING and TIME held
+// either a Unix timestamp or a converted date, are copied into the new table.
+func migrateTypedPoints(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+        CREATE TABLE Points_typed (
+            ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            LAT REAL NOT NULL,
+            LON REAL NOT NULL,
+            ALT REAL NOT NULL DEFAULT 0,
+            SPEED REAL NOT NULL DEFAULT 0,
+            TIME INTEGER NOT NULL DEFAULT 0,
+            BEARING REAL NOT NULL DEFAULT 0,
+            HDOP REAL NOT NULL DEFAULT 0,
+            ACC REAL NOT NULL DEFAULT 0,
+            USER TEXT NOT NULL,
+            SESSION TEXT NOT NULL
+        );
+    `)
+	if err != nil {
+		return err
+	}
+
+	var legacy int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'Points'").Scan(&legacy); err != nil {
+		return err
+	}
+	if legacy > 0 {
+		if err := copyLegacyPoints(tx); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DROP TABLE Points"); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range []string{
+		"ALTER TABLE Points_typed RENAME TO Points",
+		"CREATE INDEX idx_user ON Points(USER)",
+		"CREATE INDEX idx_session ON Points(SESSION)",
+		"CREATE INDEX idx_user_session ON Points(USER, SESSION)",
+		"CREATE INDEX idx_user_session_time ON Points(USER, SESSION, TIME)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDevices creates the table of the devices and their token hashes.
+func migrateDevices(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		`CREATE TABLE Devices (
+            ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            USER TEXT NOT NULL,
+            NAME TEXT NOT NULL DEFAULT '',
+            TOKEN_HASH TEXT NOT NULL UNIQUE,
+            CREATED_AT INTEGER NOT NULL,
+            REVOKED_AT INTEGER NOT NULL DEFAULT 0
+        )`,
+		"CREATE INDEX idx_devices_user ON Devices(USER)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateShares creates the table of the share links and their token hashes.
+func migrateShares(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+        CREATE TABLE Shares (
+            ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            USER TEXT NOT NULL,
+            SESSION TEXT NOT NULL DEFAULT '',
+            LIVE_ONLY INTEGER NOT NULL DEFAULT 0,
+            TIME_FROM INTEGER NOT NULL DEFAULT 0,
+            TIME_UNTIL INTEGER NOT NULL DEFAULT 0,
+            TOKEN_HASH TEXT NOT NULL UNIQUE,
+            CREATED_AT INTEGER NOT NULL,
+            EXPIRES_AT INTEGER NOT NULL,
+            REVOKED_AT INTEGER NOT NULL DEFAULT 0
+        );
+    `)
+	return err
+}
+
+// migrateGeofences creates the geofences and the table of their transitions.
+// Polygons are stored as a JSON array of [lat, lon] vertices.
+func migrateGeofences(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		`CREATE TABLE Geofences (
+            ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            USER TEXT NOT NULL DEFAULT '',
+            NAME TEXT NOT NULL,
+            TYPE TEXT NOT NULL,
+            LAT REAL NOT NULL DEFAULT 0,
+            LON REAL NOT NULL DEFAULT 0,
+            RADIUS REAL NOT NULL DEFAULT 0,
+            POLYGON TEXT NOT NULL DEFAULT '',
+            CREATED_AT INTEGER NOT NULL
+        )`,
+		`CREATE TABLE GeofenceEvents (
+            ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            GEOFENCE_ID INTEGER NOT NULL,
+            GEOFENCE TEXT NOT NULL,
+            USER TEXT NOT NULL,
+            SESSION TEXT NOT NULL,
+            TYPE TEXT NOT NULL,
+            LAT REAL NOT NULL,
+            LON REAL NOT NULL,
+            TIME INTEGER NOT NULL
+        )`,
+		"CREATE INDEX idx_geofence_events_geofence_user ON GeofenceEvents(GEOFENCE_ID, USER)",
+		"CREATE INDEX idx_geofence_events_user ON GeofenceEvents(USER)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateWebhookDeliveries creates the queue of the webhook deliveries,
+// indexed by webhook as every webhook reads its own.
+func migrateWebhookDeliveries(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		`CREATE TABLE WebhookDeliveries (
+            ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            WEBHOOK TEXT NOT NULL,
+            EVENT TEXT NOT NULL,
+            BODY TEXT NOT NULL,
+            ATTEMPTS INTEGER NOT NULL DEFAULT 0,
+            NEXT_ATTEMPT INTEGER NOT NULL,
+            CREATED_AT INTEGER NOT NULL
+        )`,
+		"CREATE INDEX idx_webhook_deliveries_webhook_next ON WebhookDeliveries(WEBHOOK, NEXT_ATTEMPT)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLegacyPoints converts the rows of a STRING typed Points table.
+func copyLegacyPoints(tx *sql.Tx) error {
+	accColumn := "'0'"
+	if ok, err := hasColumn(tx, "Points", "ACC"); err != nil {
+		return err
+	} else if ok {
+		accColumn = "ACC"
+	}
+
+	rows, err := tx.Query("SELECT ID, LAT, LON, ALT, SPEED, TIME, BEARING, HDOP, " + accColumn + ", USER, SESSION FROM Points ORDER BY ID")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	insert, err := tx.Prepare("INSERT INTO Points_typed(ID, LAT, LON, ALT, SPEED, TIME, BEARING, HDOP, ACC, USER, SESSION) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	converted := 0
+	for rows.Next() {
+		var id int64
+		var lat, lon, alt, speed, timestamp, bearing, hdop, acc, user, session string
+		if err := rows.Scan(&id, &lat, &lon, &alt, &speed, &timestamp, &bearing, &hdop, &acc, &user, &session); err != nil {
+			return err
+		}
+		var ms int64
+		if t, ok := parseStoredTime(timestamp); ok {
+			ms = t.UnixMilli()
+		}
+		_, err := insert.Exec(id, parseFloat(lat), parseFloat(lon), parseFloat(alt), parseFloat(speed), ms,
+			parseFloat(bearing), parseFloat(hdop), parseFloat(acc), user, session)
+		if err != nil {
+			return err
+		}
+		converted++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	slog.Info("Points converted", "count", converted)
+	return nil
+}
+
+// hasColumn reports whether a table has the given column.
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(name, column) {
+			found = true
+		}
+	}
+	return found, rows.Err()
+}
+
+// legacyTimeLayout is the format TimeStampConvert results were stored with
+// before the TIME column held Unix milliseconds.
+const legacyTimeLayout = "2006-01-02 15:04:05 -0700 MST"
+
+// parseStoredTime reads a legacy TIME value, which is either a Unix timestamp
+// in seconds or milliseconds or a timestamp converted by TimeStampConvert.
+func parseStoredTime(s string) (time.Time, bool) {
+	if data, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if data == 0 {
+			return time.Time{}, false
+		}
+		return time.UnixMilli(timestampMillis(data)), true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f != 0 {
+		return time.UnixMilli(timestampMillis(int64(f))), true
+	}
+	t, err := time.Parse(legacyTimeLayout, s)
+	return t, err == nil
+}
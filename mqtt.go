@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Formats of the MQTT subscriptions
+const (
+	mqttFormatOwnTracks = "owntracks"
+	mqttFormatJSON      = "json"
+)
+
+// defaultMQTTRepublishPrefix is used when MQTTRepublishPrefix is not set.
+const defaultMQTTRepublishPrefix = "golivetracking"
+
+// MQTTSubscription is a topic filter from config.yaml and the format of the
+// messages published on it.
+type MQTTSubscription struct {
+	Topic  string `yaml:"Topic"`
+	Format string `yaml:"Format"` // owntracks or json
+}
+
+// mqttBridge receives points from an MQTT broker and republishes every
+// accepted point, whatever its source, to <prefix>/<user>/<session>.
+type mqttBridge struct {
+	client        mqtt.Client
+	subscriptions []MQTTSubscription
+	prefix        string // empty when points are not republished
+
+	mu       sync.Mutex
+	closed   bool // set by stop, the messages received after are dropped
+	inflight sync.WaitGroup
+}
+
+var mqttClient = &mqttBridge{}
+
+// newMQTTBridge checks the MQTT configuration and connects to the broker.
+// The connection is retried in the background, the topics are subscribed
+// again after every reconnection.
+func newMQTTBridge(cfg Cfg) (*mqttBridge, error) {
+	b := &mqttBridge{subscriptions: cfg.MQTTSubscriptions, prefix: cfg.MQTTRepublishPrefix}
+	if cfg.MQTTBroker == "" {
+		return b, nil
+	}
+	if cfg.MQTTDisableRepublish {
+		b.prefix = ""
+	} else if b.prefix == "" {
+		b.prefix = defaultMQTTRepublishPrefix
+	}
+	for _, sub := range b.subscriptions {
+		if sub.Topic == "" {
+			return nil, fmt.Errorf("MQTT subscription without topic")
+		}
+		if sub.Format != mqttFormatOwnTracks && sub.Format != mqttFormatJSON {
+			return nil, fmt.Errorf("MQTT topic %s: format must be %q or %q", sub.Topic, mqttFormatOwnTracks, mqttFormatJSON)
+		}
+	}
+
+	clientID := cfg.MQTTClientID
+	if clientID == "" {
+		clientID = "golivetracking"
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID(clientID).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("MQTT connection lost", "error", err)
+		})
+	b.client = mqtt.NewClient(opts)
+	b.client.Connect()
+	return b, nil
+}
+
+func (b *mqttBridge) enabled() bool {
+	return b.client != nil
+}
+
+// stop disconnects from the broker and waits for the received points being
+// stored.
+func (b *mqttBridge) stop() {
+	if !b.enabled() {
+		return
+	}
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.client.Disconnect(250)
+	b.inflight.Wait()
+}
+
+// subscribe subscribes the configured topics once connected.
+func (b *mqttBridge) subscribe(c mqtt.Client) {
+	slog.Info("MQTT connected")
+	for _, sub := range b.subscriptions {
+		token := c.Subscribe(sub.Topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			b.receive(sub, msg)
+		})
+		go func() {
+			if token.Wait() && token.Error() != nil {
+				slog.Error("MQTT subscription failed", "topic", sub.Topic, "error", token.Error())
+			}
+		}()
+	}
+}
+
+// receive validates and stores a point published on a subscribed topic.
+func (b *mqttBridge) receive(sub MQTTSubscription, msg mqtt.Message) {
+	// Add must not run concurrently with the Wait of stop
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.inflight.Add(1)
+	b.mu.Unlock()
+	defer b.inflight.Done()
+
+	// Skip the points republished by this server
+	if b.republished(msg.Topic()) {
+		return
+	}
+
+	logger := slog.Default().With("topic", msg.Topic())
+	var params pointParams
+	location := true
+	var err error
+	switch sub.Format {
+	case mqttFormatOwnTracks:
+		params, location, err = owntracksMQTTParams(msg.Topic(), msg.Payload())
+	case mqttFormatJSON:
+		params, err = jsonMQTTParams(msg.Payload())
+	}
+	if err != nil {
+		reason := rejectBadRequest
+		if errors.Is(err, errUnauthorized) || errors.Is(err, errForbidden) {
+			reason = addPointErrors[authErrorStatus(err)]
+		}
+		logRejectedPoint(logger, params, reason, err)
+		pointsRejected.WithLabelValues(reason).Inc()
+		return
+	}
+	if !location {
+		return
+	}
+
+	logger.Debug("Point received", params.logAttrs()...)
+
+	point, err := validatePoint(params)
+	if err != nil {
+		logRejectedPoint(logger, params, "", err)
+		return
+	}
+	if err := recordPoint(point); err != nil {
+		logRejectedPoint(logger, params, rejectStoreError, err)
+		pointsRejected.WithLabelValues(rejectStoreError).Inc()
+	}
+}
+
+// owntracksMQTTParams reads a message of OwnTracks in MQTT mode, published on
+// owntracks/<user>/<device>. The user is mapped by owntracksUser, the session
+// by owntracksSession. The broker authenticates the clients.
+// transition, waypoint, lwt and the other types are reported as not being a
+// location and are not stored.
+func owntracksMQTTParams(topic string, payload []byte) (pointParams, bool, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 {
+		return pointParams{}, false, fmt.Errorf("topic is not owntracks/<user>/<device>")
+	}
+
+	var msg owntracksMessage
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&msg); err != nil {
+		return pointParams{}, false, err
+	}
+	if msg.Type != "location" {
+		return pointParams{}, false, nil
+	}
+
+	user, err := owntracksUser(credential{}, levels[len(levels)-2])
+	if err != nil {
+		return pointParams{}, false, err
+	}
+	return msg.params(user, owntracksSession(levels[len(levels)-1])), true, nil
+}
+
+// jsonMQTTParams reads a point in the JSON format of the batch upload. Like
+// /addpoint, it needs the key of the user or a device token in its key field.
+func jsonMQTTParams(payload []byte) (pointParams, error) {
+	var item struct {
+		batchPoint
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(payload, &item); err != nil {
+		return pointParams{}, err
+	}
+
+	params := item.params()
+	user, err := authorizeUser(item.Key, params.User)
+	if err != nil {
+		return pointParams{}, err
+	}
+	params.User = user
+	return params, nil
+}
+
+// republished reports whether a topic is one the points are republished on.
+func (b *mqttBridge) republished(topic string) bool {
+	if b.prefix == "" || !strings.HasPrefix(topic, b.prefix+"/") {
+		return false
+	}
+	levels := strings.Split(strings.TrimPrefix(topic, b.prefix+"/"), "/")
+	return len(levels) == 2 && isNumeric(levels[0]) && isNumeric(levels[1])
+}
+
+// publish republishes an accepted point with the data of the SSE location
+// event. It does not wait for the broker, points are dropped while the
+// connection is down.
+func (b *mqttBridge) publish(p Point) {
+	if !b.enabled() || b.prefix == "" || !b.client.IsConnectionOpen() {
+		return
+	}
+
+	data, err := json.Marshal(p.LatLng())
+	if err != nil {
+		slog.Error("Error marshaling JSON", "error", err)
+		return
+	}
+	b.client.Publish(fmt.Sprintf("%s/%s/%s", b.prefix, p.User, p.Session), 1, false, data)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttTestURL names the environment variable of the MQTT broker the bridge
+// is also tested against, for example tcp://localhost:1883. The test topics
+// are under a prefix unique to each run.
+const mqttTestURL = "GLT_TEST_MQTT_URL"
+
+// fakeMessage is a message as delivered by the MQTT client.
+type fakeMessage struct {
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 1 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+// useTestConfig replaces the configuration for the duration of a test.
+func useTestConfig(t *testing.T, cfg Cfg) {
+	previous := AppConfig
+	AppConfig = cfg
+	t.Cleanup(func() { AppConfig = previous })
+}
+
+// storedSessions returns the user/session of every stored point.
+func storedSessions(t *testing.T) []string {
+	points, err := store.FetchPoints(PointQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []string
+	for _, p := range points {
+		sessions = append(sessions, p.User+"/"+p.Session)
+	}
+	return sessions
+}
+
+func TestMQTTReceiveOwnTracks(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, Cfg{MaxGetParmLen: 20})
+	_, err := store.AddDevice(Device{User: "3", Name: "alice", TokenHash: "hash", CreatedAt: 1})
+	must(t, err)
+	b := &mqttBridge{prefix: defaultMQTTRepublishPrefix}
+	sub := MQTTSubscription{Topic: "owntracks/#", Format: mqttFormatOwnTracks}
+
+	for _, msg := range []fakeMessage{
+		{"owntracks/5/2", `{"_type":"location","lat":45.1,"lon":9.2,"tst":1714550400}`},
+		{"owntracks/alice/phone", `{"_type":"location","lat":45.2,"lon":9.3,"tst":1714550401}`},
+		// No device is named bob
+		{"owntracks/bob/phone", `{"_type":"location","lat":45.3,"lon":9.4,"tst":1714550402}`},
+		{"owntracks/5/2", `{"_type":"transition","lat":45.4,"lon":9.5,"tst":1714550403}`},
+		{"owntracks/5/2", `{"_type":"location","lat":95,"lon":9.5,"tst":1714550404}`},
+		{"owntracks/5", `{"_type":"location","lat":45.5,"lon":9.6,"tst":1714550405}`},
+		{"owntracks/5/2", `not json`},
+	} {
+		b.receive(sub, msg)
+	}
+
+	got := storedSessions(t)
+	if want := []string{"5/2", "3/0"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("stored points = %v, want %v", got, want)
+	}
+}
+
+func TestMQTTReceiveJSON(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, Cfg{MaxGetParmLen: 20, Key: "secret"})
+	b := &mqttBridge{prefix: defaultMQTTRepublishPrefix}
+	sub := MQTTSubscription{Topic: "#", Format: mqttFormatJSON}
+
+	for _, msg := range []fakeMessage{
+		{"tracker/1", `{"lat":45.2,"lon":9.3,"timestamp":1714550400,"user":"1","session":"3","key":"secret"}`},
+		{"tracker/1", `{"lat":45.2,"lon":9.3,"timestamp":1714550401,"user":"1","session":"3","key":"wrong"}`},
+		// Republished by this server
+		{"golivetracking/1/3", `{"lat":45.2,"lon":9.3,"timestamp":1714550402,"user":"1","session":"3","key":"secret"}`},
+	} {
+		b.receive(sub, msg)
+	}
+
+	if got := storedSessions(t); len(got) != 1 || got[0] != "1/3" {
+		t.Errorf("stored points = %v, want [1/3]", got)
+	}
+}
+
+func TestMQTTBroker(t *testing.T) {
+	broker := os.Getenv(mqttTestURL)
+	if broker == "" {
+		t.Skip(mqttTestURL + " not set")
+	}
+	useTestStore(t)
+	prefix := fmt.Sprintf("glt-test-%d", time.Now().UnixNano())
+	cfg := Cfg{
+		MaxGetParmLen:       20,
+		Key:                 "secret",
+		MQTTBroker:          broker,
+		MQTTClientID:        prefix + "-bridge",
+		MQTTSubscriptions:   []MQTTSubscription{{Topic: prefix + "/in/#", Format: mqttFormatJSON}},
+		MQTTRepublishPrefix: prefix + "/out",
+	}
+	useTestConfig(t, cfg)
+
+	b, err := newMQTTBridge(cfg)
+	must(t, err)
+	previous := mqttClient
+	mqttClient = b
+	t.Cleanup(func() {
+		b.stop()
+		mqttClient = previous
+	})
+
+	// The client of the test publishes the point and receives its
+	// republication
+	republished := make(chan LatLng, 10)
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID(prefix + "-test"))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	token := c.Subscribe(prefix+"/out/#", 1, func(_ mqtt.Client, msg mqtt.Message) {
+		var l LatLng
+		if err := json.Unmarshal(msg.Payload(), &l); err != nil {
+			t.Errorf("republished payload %q: %v", msg.Payload(), err)
+			return
+		}
+		republished <- l
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	// The bridge subscribes once connected, publish until it receives
+	payload := `{"lat":45.2,"lon":9.3,"timestamp":1714550400,"user":"1","session":"3","key":"secret"}`
+	deadline := time.After(10 * time.Second)
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for received := false; !received; {
+		c.Publish(prefix+"/in/tracker", 1, false, payload)
+		select {
+		case l := <-republished:
+			if l.User != "1" || l.Session != "3" || l.Lat != "45.2" || l.Lng != "9.3" {
+				t.Errorf("republished point = %+v, want user 1 session 3 at 45.2,9.3", l)
+			}
+			received = true
+		case <-tick.C:
+		case <-deadline:
+			t.Fatal("point not republished by the bridge")
+		}
+	}
+
+	got := storedSessions(t)
+	if len(got) == 0 {
+		t.Fatal("point not stored")
+	}
+	for _, s := range got {
+		if s != "1/3" {
+			t.Errorf("stored points = %v, want 1/3 only", got)
+		}
+	}
+}
+
+func TestMQTTReceiveAfterStop(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, Cfg{MaxGetParmLen: 20})
+	b := &mqttBridge{closed: true}
+	b.receive(MQTTSubscription{Format: mqttFormatOwnTracks}, fakeMessage{"owntracks/5/2", `{"_type":"location","lat":45.1,"lon":9.2}`})
+
+	if got := storedSessions(t); len(got) != 0 {
+		t.Errorf("stored points after stop = %v", got)
+	}
+}
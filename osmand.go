@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPointBodySize limits the body accepted for a single point.
+const maxPointBodySize = 1 << 20
+
+// Factors converting the speeds sent by the trackers to m/s, the unit of the
+// stored points
+const (
+	knotsToMps = 1852.0 / 3600
+	kmhToMps   = 1 / 3.6
+)
+
+// pointParams holds the raw, unvalidated values of a point as sent by a
+// tracker, the speed already in m/s.
+type pointParams struct {
+	Lat       string
+	Lon       string
+	Timestamp string
+	Altitude  string
+	Speed     string
+	Bearing   string
+	Hdop      string
+	Acc       string
+	User      string
+	Session   string
+	Key       string
+}
+
+// logAttrs returns the values of a point for a debug record, without the key.
+func (p pointParams) logAttrs() []any {
+	return []any{
+		"lat", p.Lat, "lon", p.Lon, "timestamp", p.Timestamp, "altitude", p.Altitude,
+		"speed", p.Speed, "bearing", p.Bearing, "hdop", p.Hdop, "accuracy", p.Acc,
+		"user", p.User, "session", p.Session,
+	}
+}
+
+// traccarLocation is the JSON body posted by newer Traccar Client versions.
+type traccarLocation struct {
+	DeviceID string `json:"device_id"`
+	Location struct {
+		Timestamp string `json:"timestamp"`
+		Coords    struct {
+			Latitude  json.Number `json:"latitude"`
+			Longitude json.Number `json:"longitude"`
+			Accuracy  json.Number `json:"accuracy"`
+			Speed     json.Number `json:"speed"`
+			Heading   json.Number `json:"heading"`
+			Altitude  json.Number `json:"altitude"`
+		} `json:"coords"`
+	} `json:"location"`
+}
+
+// readPointParams collects the values of a point from the query string, a
+// form encoded body or a JSON body. Besides the native parameter names it
+// understands the Traccar OsmAnd protocol (id, accuracy, heading, ...) and the
+// JSON format of Traccar Client. Values we do not store, like batt, are ignored.
+func readPointParams(w http.ResponseWriter, r *http.Request) (pointParams, error) {
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxPointBodySize)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/json" {
+			return readJSONPointParams(r)
+		}
+		if err := r.ParseForm(); err != nil {
+			return pointParams{}, err
+		}
+	}
+
+	get := func(names ...string) string {
+		for _, name := range names {
+			if v := r.FormValue(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	params := pointParams{
+		Lat:       get("lat"),
+		Lon:       get("lon"),
+		Timestamp: normalizeTimestamp(get("timestamp")),
+		Altitude:  get("altitude"),
+		Speed:     get("speed"),
+		Bearing:   get("bearing", "heading"),
+		Hdop:      get("hdop"),
+		Acc:       get("accuracy", "acc"),
+		User:      get("user", "id", "deviceid"),
+		Session:   get("session"),
+		Key:       get("key"),
+	}
+
+	// Some OsmAnd versions send the position as location=lat,lon
+	if params.Lat == "" && params.Lon == "" {
+		if lat, lon, ok := strings.Cut(get("location"), ","); ok {
+			params.Lat, params.Lon = lat, lon
+		}
+	}
+
+	// The OsmAnd protocol, which gives the user as id, sends the speed in knots
+	if r.FormValue("user") == "" && get("id", "deviceid") != "" {
+		params.Speed = convertSpeed(params.Speed, knotsToMps)
+	}
+	return params, nil
+}
+
+// readJSONPointParams decodes a Traccar Client JSON body, whose speed is in
+// m/s. The user can also be given in the query string, which is where the key
+// and session are read from.
+func readJSONPointParams(r *http.Request) (pointParams, error) {
+	var body traccarLocation
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return pointParams{}, fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	query := r.URL.Query()
+	user := query.Get("user")
+	if user == "" {
+		user = body.DeviceID
+	}
+	coords := body.Location.Coords
+	return pointParams{
+		Lat:       coords.Latitude.String(),
+		Lon:       coords.Longitude.String(),
+		Timestamp: normalizeTimestamp(body.Location.Timestamp),
+		Altitude:  coords.Altitude.String(),
+		Speed:     coords.Speed.String(),
+		Bearing:   coords.Heading.String(),
+		Hdop:      query.Get("hdop"),
+		Acc:       coords.Accuracy.String(),
+		User:      user,
+		Session:   query.Get("session"),
+		Key:       query.Get("key"),
+	}, nil
+}
+
+// convertSpeed converts a speed to m/s with factor, rounded to the cm/s so it
+// stays within MaxGetParmLen. Values that are not numbers are returned
+// unchanged for validatePoint to refuse.
+func convertSpeed(speed string, factor float64) string {
+	f, err := strconv.ParseFloat(speed, 64)
+	if err != nil || !isNumeric(speed) {
+		return speed
+	}
+	return strconv.FormatFloat(math.Round(f*factor*100)/100, 'f', -1, 64)
+}
+
+// normalizeTimestamp turns an ISO 8601 timestamp into Unix milliseconds so it
+// passes the same validation as the numeric ones. Other values are returned
+// unchanged.
+func normalizeTimestamp(timestamp string) string {
+	if timestamp == "" || isNumeric(timestamp) {
+		return timestamp
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, timestamp); err == nil {
+			return strconv.FormatInt(t.UnixMilli(), 10)
+		}
+	}
+	return timestamp
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// owntracksMessage is a message posted by OwnTracks in HTTP mode.
+// Only the fields of the location type are decoded.
+type owntracksMessage struct {
+	Type string      `json:"_type"`
+	Lat  json.Number `json:"lat"`
+	Lon  json.Number `json:"lon"`
+	Tst  json.Number `json:"tst"`
+	Acc  json.Number `json:"acc"`
+	Alt  json.Number `json:"alt"`
+	Vel  json.Number `json:"vel"`
+	Cog  json.Number `json:"cog"`
+}
+
+// params returns the /addpoint parameters of a location message, whose
+// speed is in km/h.
+func (msg owntracksMessage) params(user, session string) pointParams {
+	return pointParams{
+		Lat:       msg.Lat.String(),
+		Lon:       msg.Lon.String(),
+		Timestamp: msg.Tst.String(),
+		Altitude:  msg.Alt.String(),
+		Speed:     convertSpeed(msg.Vel.String(), kmhToMps),
+		Bearing:   msg.Cog.String(),
+		Acc:       msg.Acc.String(),
+		User:      user,
+		Session:   session,
+	}
+}
+
+// owntracksLocation is a friend's position returned to OwnTracks.
+type owntracksLocation struct {
+	Type  string  `json:"_type"`
+	Topic string  `json:"topic"`
+	Tid   string  `json:"tid"`
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Tst   int64   `json:"tst"`
+	Acc   float64 `json:"acc,omitempty"`
+	Alt   float64 `json:"alt,omitempty"`
+	Vel   float64 `json:"vel,omitempty"`
+	Cog   float64 `json:"cog,omitempty"`
+}
+
+// owntracksHandler receives the messages of OwnTracks in HTTP mode.
+// The user comes from the X-Limit-U header or the basic auth username, see
+// owntracksUser, the key from the basic auth password or the key parameter.
+// With a device token the user can be left empty. The session is the session
+// parameter of the configured URL, else the X-Limit-D device, see
+// owntracksSession.
+// Every accepted location is answered with the last positions of the other
+// users the key may see, see owntracksFriends.
+func owntracksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger := requestLogger(r)
+	authUser, key, hasAuth := r.BasicAuth()
+	if !hasAuth {
+		key = r.URL.Query().Get("key")
+	}
+	requested := r.Header.Get("X-Limit-U")
+	if requested == "" {
+		requested = authUser
+	}
+	cred, err := authenticate(key)
+	var user string
+	if err == nil {
+		user, err = owntracksUser(cred, requested)
+	}
+	if err == nil {
+		user, err = cred.resolveUser(user)
+	}
+	if err != nil {
+		reason := addPointErrors[authErrorStatus(err)]
+		logRejectedPoint(logger, pointParams{User: requested}, reason, err)
+		pointsRejected.WithLabelValues(reason).Inc()
+		writeAuthError(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPointBodySize)
+	var msg owntracksMessage
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&msg); err != nil {
+		logRejectedPoint(logger, pointParams{User: user}, rejectBadRequest, err)
+		pointsRejected.WithLabelValues(rejectBadRequest).Inc()
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// transition, waypoint, lwt and the other types are acknowledged but not stored
+	if msg.Type != "location" {
+		w.Write([]byte("[]"))
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		session = owntracksSession(r.Header.Get("X-Limit-D"))
+	}
+	params := msg.params(user, session)
+	point, err := validatePoint(params)
+	if err != nil {
+		logRejectedPoint(logger, params, "", err)
+		if AppConfig.LegacyAddPointErrors {
+			w.Write([]byte("[]"))
+			return
+		}
+		writeAddPointError(w, pointErrorStatus(err), err)
+		return
+	}
+
+	if err := recordPoint(point); err != nil {
+		logRejectedPoint(logger, params, rejectStoreError, err)
+		pointsRejected.WithLabelValues(rejectStoreError).Inc()
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	friends, err := owntracksFriends(cred, point.User)
+	if err != nil {
+		logger.Error("Error querying database", "error", err)
+		friends = []owntracksLocation{}
+	}
+	json.NewEncoder(w).Encode(friends)
+}
+
+// owntracksUser maps an OwnTracks username to a user. A user number is kept,
+// any other name is the name of a device: the one of the device token cred
+// is, else the newest active device with that name, see add-device. Names
+// without a device are kept and refused by validatePoint.
+func owntracksUser(cred credential, name string) (string, error) {
+	if name == "" || isNumeric(name) {
+		return name, nil
+	}
+	if cred.Device != nil {
+		return cred.Device.User, nil
+	}
+	device, err := store.DeviceByName(name)
+	if err != nil || device == nil {
+		return name, err
+	}
+	return device.User, nil
+}
+
+// owntracksSession returns the session of an OwnTracks device: the device
+// when it is a number, otherwise none, so session 0.
+func owntracksSession(device string) string {
+	if isNumeric(device) {
+		return device
+	}
+	return ""
+}
+
+// owntracksFriends returns the last position of the users other than user
+// that cred may see: every one with the admin or shared key, none with a
+// device token, which only sees its own user.
+func owntracksFriends(cred credential, user string) ([]owntracksLocation, error) {
+	friends := []owntracksLocation{}
+	if !cred.Admin && !cred.Shared {
+		return friends, nil
+	}
+	positions, err := getLastKnownPositions("0")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range positions {
+		if p.User == user {
+			continue
+		}
+		loc := owntracksLocation{
+			Type:  "location",
+			Topic: fmt.Sprintf("owntracks/%s/%s", p.User, p.Session),
+			Tid:   owntracksTid(p.User),
+			Lat:   parseFloat(p.Lat),
+			Lon:   parseFloat(p.Lng),
+			Acc:   parseFloat(p.Acc),
+			Alt:   parseFloat(p.Alt),
+			Vel:   math.Round(parseFloat(p.Speed) / kmhToMps),
+			Cog:   parseFloat(p.Bear),
+		}
+		if p.Timestamp != 0 {
+			loc.Tst = p.Timestamp / 1000
+		}
+		friends = append(friends, loc)
+	}
+	return friends, nil
+}
+
+// owntracksTid returns the two characters OwnTracks shows on a friend's marker.
+func owntracksTid(user string) string {
+	if len(user) > 2 {
+		return user[len(user)-2:]
+	}
+	return user
+}
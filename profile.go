@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+)
+
+// profilePoint is a point of the altitude and speed charts of a session.
+type profilePoint struct {
+	Lat       float64 `json:"lat"`
+	Lon       float64 `json:"lon"`
+	Alt       float64 `json:"alt"`
+	Speed     float64 `json:"speed"`
+	Timestamp int64   `json:"timestamp,omitempty"` // Unix milliseconds
+	Distance  float64 `json:"distance_m"`          // from the first point
+}
+
+// profileTrack is the answer of /api/profile.
+type profileTrack struct {
+	User    string         `json:"user"`
+	Session string         `json:"session"`
+	Color   string         `json:"color"`
+	Points  []profilePoint `json:"points"`
+}
+
+// getProfile returns the altitude and speed of every point of a session with
+// the distance covered, for the charts under the map. It takes the same
+// parameters as /api/replay. Altitudes and speeds are the ones sent by the
+// trackers.
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	q, ok := sessionPointQuery(w, r)
+	if !ok {
+		return
+	}
+
+	points, err := store.FetchPoints(q)
+	if err != nil {
+		requestLogger(r).Error("Error querying database", "error", err)
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+
+	track := profileTrack{User: q.User, Session: q.Session, Color: userColor(q.User), Points: make([]profilePoint, 0, len(points))}
+	var distance float64
+	for i, p := range points {
+		if i > 0 {
+			distance += haversine(points[i-1].Lat, points[i-1].Lon, p.Lat, p.Lon)
+		}
+		track.Points = append(track.Points, profilePoint{
+			Lat:       p.Lat,
+			Lon:       p.Lon,
+			Alt:       p.Alt,
+			Speed:     p.Speed,
+			Timestamp: p.Time,
+			Distance:  distance,
+		})
+	}
+	writeJSON(w, http.StatusOK, track)
+}
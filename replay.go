@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// replayPoint is a recorded position played back by the map.
+type replayPoint struct {
+	Lat       float64 `json:"lat"`
+	Lon       float64 `json:"lon"`
+	Alt       float64 `json:"alt"`
+	Speed     float64 `json:"speed"`
+	Bearing   float64 `json:"bearing"`
+	Timestamp int64   `json:"timestamp"` // Unix milliseconds
+	Time      string  `json:"time"`      // RFC 3339, UTC
+}
+
+// replayTrack is the answer of /api/replay.
+type replayTrack struct {
+	User    string        `json:"user"`
+	Session string        `json:"session"`
+	Color   string        `json:"color"`
+	Points  []replayPoint `json:"points"`
+}
+
+// sessionPointQuery reads the user, session and share parameters of the map
+// for the endpoints that load a single session. A share without session
+// needs the session parameter. It answers the request and returns false when
+// they are refused.
+func sessionPointQuery(w http.ResponseWriter, r *http.Request) (PointQuery, bool) {
+	user := r.URL.Query().Get("user")
+	session := r.URL.Query().Get("session")
+
+	share, err := requestShare(r)
+	if err != nil {
+		writeShareError(w, r, err)
+		return PointQuery{}, false
+	}
+	q := PointQuery{}
+	if share != nil {
+		if share.LiveOnly {
+			http.NotFound(w, r)
+			return PointQuery{}, false
+		}
+		user, q.From, q.Until = share.User, share.From, share.Until
+		if share.Session != "" {
+			session = share.Session
+		}
+	}
+
+	if user == "" || !isNumeric(user) || len(user) > AppConfig.MaxGetParmLen {
+		http.Error(w, "Invalid user parameter", http.StatusBadRequest)
+		return PointQuery{}, false
+	}
+	if session == "" || !isNumeric(session) || len(session) > AppConfig.MaxGetParmLen {
+		http.Error(w, "Invalid session parameter", http.StatusBadRequest)
+		return PointQuery{}, false
+	}
+	q.User, q.Session = user, session
+	return q, true
+}
+
+// getReplay returns the points of a session in time order for the replay of
+// the map. Points without a timestamp cannot be placed on the timeline and
+// are left out.
+func getReplay(w http.ResponseWriter, r *http.Request) {
+	q, ok := sessionPointQuery(w, r)
+	if !ok {
+		return
+	}
+
+	points, err := store.FetchPoints(q)
+	if err != nil {
+		requestLogger(r).Error("Error querying database", "error", err)
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+
+	track := replayTrack{User: q.User, Session: q.Session, Color: userColor(q.User), Points: make([]replayPoint, 0, len(points))}
+	for _, p := range points {
+		if p.Time == 0 {
+			continue
+		}
+		track.Points = append(track.Points, replayPoint{
+			Lat:       p.Lat,
+			Lon:       p.Lon,
+			Alt:       p.Alt,
+			Speed:     p.Speed,
+			Bearing:   p.Bearing,
+			Timestamp: p.Time,
+			Time:      time.UnixMilli(p.Time).UTC().Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, http.StatusOK, track)
+}
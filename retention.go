@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// defaultRetentionInterval is used when RetentionInterval is not set.
+const defaultRetentionInterval = time.Hour
+
+// RetentionPolicy is the retention of the points of a user from config.yaml.
+// It replaces the global policy for that user, a field left at 0 disables
+// that part of the policy.
+type RetentionPolicy struct {
+	User       string `yaml:"User"`
+	Days       int    `yaml:"Days"`       // points older are deleted
+	FullDays   int    `yaml:"FullDays"`   // points older are downsampled
+	Downsample string `yaml:"Downsample"` // interval of the kept points
+}
+
+// retentionRule is a parsed RetentionPolicy.
+type retentionRule struct {
+	maxAge         time.Duration
+	fullResolution time.Duration
+	interval       time.Duration
+}
+
+func (r retentionRule) enabled() bool {
+	return r.maxAge > 0 || r.fullResolution > 0
+}
+
+// retentionJob deletes and downsamples the old points in the background.
+type retentionJob struct {
+	global   retentionRule
+	users    map[string]retentionRule
+	interval time.Duration
+	rewrite  bool // RetentionVacuum, see Store.Vacuum
+	quit     chan struct{}
+	stopped  chan struct{}
+}
+
+var retention = &retentionJob{}
+
+// newRetentionJob checks the retention configuration.
+func newRetentionJob(cfg Cfg) (*retentionJob, error) {
+	j := &retentionJob{
+		users:    make(map[string]retentionRule),
+		interval: defaultRetentionInterval,
+		rewrite:  cfg.RetentionVacuum,
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	var err error
+	global := RetentionPolicy{
+		Days:       cfg.RetentionDays,
+		FullDays:   cfg.RetentionFullDays,
+		Downsample: cfg.RetentionDownsample,
+	}
+	if j.global, err = parseRetentionPolicy(global); err != nil {
+		return nil, err
+	}
+	for _, policy := range cfg.RetentionUsers {
+		if policy.User == "" || !isNumeric(policy.User) {
+			return nil, fmt.Errorf("RetentionUsers: invalid user %q", policy.User)
+		}
+		if _, ok := j.users[policy.User]; ok {
+			return nil, fmt.Errorf("RetentionUsers: user %s listed twice", policy.User)
+		}
+		rule, err := parseRetentionPolicy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("RetentionUsers: user %s: %w", policy.User, err)
+		}
+		j.users[policy.User] = rule
+	}
+
+	if cfg.RetentionInterval != "" {
+		if j.interval, err = time.ParseDuration(cfg.RetentionInterval); err != nil {
+			return nil, fmt.Errorf("RetentionInterval: %w", err)
+		}
+		if j.interval <= 0 {
+			return nil, fmt.Errorf("RetentionInterval must be positive")
+		}
+	}
+	return j, nil
+}
+
+func parseRetentionPolicy(policy RetentionPolicy) (retentionRule, error) {
+	if policy.Days < 0 || policy.FullDays < 0 {
+		return retentionRule{}, fmt.Errorf("retention days must not be negative")
+	}
+	if policy.Days > 0 && policy.FullDays > policy.Days {
+		return retentionRule{}, fmt.Errorf("the full resolution days (%d) must not exceed the retention days (%d)", policy.FullDays, policy.Days)
+	}
+	rule := retentionRule{
+		maxAge:         time.Duration(policy.Days) * 24 * time.Hour,
+		fullResolution: time.Duration(policy.FullDays) * 24 * time.Hour,
+	}
+	if rule.fullResolution == 0 {
+		return rule, nil
+	}
+	if policy.Downsample == "" {
+		return retentionRule{}, fmt.Errorf("the full resolution days need a downsample interval")
+	}
+	interval, err := time.ParseDuration(policy.Downsample)
+	if err != nil {
+		return retentionRule{}, fmt.Errorf("downsample interval: %w", err)
+	}
+	if interval < time.Second {
+		return retentionRule{}, fmt.Errorf("the downsample interval must be at least 1s")
+	}
+	rule.interval = interval
+	return rule, nil
+}
+
+// enabled reports whether any user has a retention policy.
+func (j *retentionJob) enabled() bool {
+	if j.global.enabled() {
+		return true
+	}
+	for _, rule := range j.users {
+		if rule.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the retention policy of a user.
+func (j *retentionJob) rule(user string) retentionRule {
+	if rule, ok := j.users[user]; ok {
+		return rule
+	}
+	return j.global
+}
+
+// run enforces the retention policies at startup and then every interval,
+// until stop is called.
+func (j *retentionJob) run() {
+	defer close(j.stopped)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		j.prune(time.Now())
+		select {
+		case <-ticker.C:
+		case <-j.quit:
+			return
+		}
+	}
+}
+
+// stop waits for the pruning in progress and ends run.
+func (j *retentionJob) stop() {
+	if !j.enabled() {
+		return
+	}
+	close(j.quit)
+	<-j.stopped
+}
+
+// prune deletes the points older than the maximum age of their user and
+// downsamples the ones older than the full resolution period. Points without
+// a timestamp are never removed. The freed space is then returned to the
+// system, see Store.Vacuum.
+func (j *retentionJob) prune(now time.Time) {
+	users, err := store.LastPositions("0")
+	if err != nil {
+		slog.Error("Retention cannot list the users", "error", err)
+		return
+	}
+
+	var removed int64
+	for _, last := range users {
+		rule := j.rule(last.User)
+		if rule.maxAge > 0 {
+			before := now.Add(-rule.maxAge)
+			n, err := store.DeletePointsBefore(last.User, before.UnixMilli())
+			if err != nil {
+				slog.Error("Retention cannot delete the old points", "user", last.User, "error", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("Retention deleted old points", "user", last.User, "before", before.Format(time.DateTime), "removed", n)
+			}
+			removed += n
+		}
+		if rule.fullResolution > 0 {
+			before := now.Add(-rule.fullResolution)
+			n, err := store.DownsamplePoints(last.User, before.UnixMilli(), rule.interval.Milliseconds())
+			if err != nil {
+				slog.Error("Retention cannot downsample the points", "user", last.User, "error", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("Retention downsampled old points", "user", last.User, "before", before.Format(time.DateTime), "interval", rule.interval, "removed", n)
+			}
+			removed += n
+		}
+	}
+	if removed == 0 {
+		return
+	}
+
+	sessionStats.reset()
+	liveSessions.forget("")
+	if err := store.Vacuum(j.rewrite); err != nil {
+		slog.Error("Retention vacuum error", "error", err)
+	}
+}
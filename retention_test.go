@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// autoVacuum returns the auto-vacuum mode of a SQLite store.
+func autoVacuum(t *testing.T, s Store) int {
+	t.Helper()
+	var mode int
+	must(t, s.(*sqlStore).db.QueryRow("PRAGMA auto_vacuum").Scan(&mode))
+	return mode
+}
+
+func TestRetentionConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Cfg
+		valid bool
+	}{
+		{"disabled", Cfg{}, true},
+		{"downsampled then deleted", Cfg{RetentionDays: 30, RetentionFullDays: 7, RetentionDownsample: "5m"}, true},
+		{"downsampled forever", Cfg{RetentionFullDays: 7, RetentionDownsample: "5m"}, true},
+		{"deleted before downsampled", Cfg{RetentionDays: 7, RetentionFullDays: 30, RetentionDownsample: "5m"}, false},
+		{"user deleted before downsampled", Cfg{RetentionUsers: []RetentionPolicy{{User: "1", Days: 7, FullDays: 30, Downsample: "5m"}}}, false},
+		{"no downsample interval", Cfg{RetentionFullDays: 7}, false},
+		{"negative days", Cfg{RetentionDays: -1}, false},
+	} {
+		_, err := newRetentionJob(tc.cfg)
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("%s: error %v, want valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestSQLiteIncrementalVacuum(t *testing.T) {
+	s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	must(t, err)
+	defer s.Close()
+	if mode := autoVacuum(t, s); mode != sqliteIncrementalVacuum {
+		t.Errorf("auto_vacuum of a new database = %d, want %d", mode, sqliteIncrementalVacuum)
+	}
+
+	// A database of an older version is only rewritten when allowed
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	must(t, err)
+	_, err = db.Exec("CREATE TABLE Old(ID INTEGER)")
+	must(t, err)
+	db.Close()
+	old, err := OpenSQLiteStore(path)
+	must(t, err)
+	defer old.Close()
+	must(t, old.Vacuum(false))
+	if mode := autoVacuum(t, old); mode == sqliteIncrementalVacuum {
+		t.Error("database rewritten without rewrite")
+	}
+	must(t, old.Vacuum(true))
+	if mode := autoVacuum(t, old); mode != sqliteIncrementalVacuum {
+		t.Errorf("auto_vacuum after the rewrite = %d, want %d", mode, sqliteIncrementalVacuum)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeouts of the HTTP and HTTPS servers. The SSE streams, the track exports
+// and the uploads extend them before every write or read, see streamWriter
+// and streamReader.
+const (
+	serverReadTimeout  = 15 * time.Second
+	serverWriteTimeout = 30 * time.Second
+	serverIdleTimeout  = 2 * time.Minute
+	// shutdownTimeout bounds the wait for the requests in progress.
+	shutdownTimeout = 15 * time.Second
+)
+
+// newServer configures a listener on an address with the timeouts above.
+func newServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+	// End the SSE streams, Shutdown waits for them like for any request
+	srv.RegisterOnShutdown(liveHub.Close)
+	return srv
+}
+
+// serve runs the configured listeners concurrently until ctx is done or one
+// of them fails, then shuts them down. The requests in progress are given
+// shutdownTimeout to finish.
+func serve(ctx context.Context, handler http.Handler) error {
+	if AppConfig.RedirectHTTP && !AppConfig.EnableTLS {
+		return fmt.Errorf("RedirectHTTP needs EnableTLS")
+	}
+	if len(AppConfig.ACMEDomains) > 0 && !AppConfig.EnableTLS {
+		return fmt.Errorf("ACMEDomains needs EnableTLS")
+	}
+
+	var servers []*http.Server
+	var challenges func(http.Handler) http.Handler
+	errc := make(chan error, 3)
+	if AppConfig.EnableTLS {
+		tlsConfig, acmeHandler, err := newTLSConfig(AppConfig)
+		if err != nil {
+			return err
+		}
+		challenges = acmeHandler
+		srv := newServer(":"+AppConfig.ServerPortTLS, handler)
+		srv.TLSConfig = tlsConfig
+		servers = append(servers, srv)
+		go func() {
+			errc <- srv.ListenAndServeTLS("", "")
+		}()
+	}
+	if !AppConfig.DisableNoTLS {
+		plain := handler
+		if AppConfig.RedirectHTTP {
+			plain = http.HandlerFunc(redirectHTTPS)
+		}
+		if challenges != nil {
+			plain = challenges(plain)
+		}
+		srv := newServer(":"+AppConfig.ServerPort, plain)
+		servers = append(servers, srv)
+		go func() {
+			errc <- srv.ListenAndServe()
+		}()
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("no listener, DisableNoTLS needs EnableTLS")
+	}
+	if AppConfig.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", metricsHandler())
+		srv := newServer(AppConfig.MetricsAddr, mux)
+		servers = append(servers, srv)
+		go func() {
+			errc <- srv.ListenAndServe()
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	case err = <-errc:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Shutdown error", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return err
+}
+
+// redirectHTTPS sends the requests of the HTTP listener to the same URL on
+// the HTTPS listener. GET and HEAD are redirected with 301, the other methods
+// with 308 so they are repeated with their body.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := (&url.URL{Host: r.Host}).Hostname()
+	if AppConfig.ServerPortTLS != "443" {
+		host = net.JoinHostPort(host, AppConfig.ServerPortTLS)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
+
+// streamWriter extends the write deadline of a long-lived response before
+// every write, so the WriteTimeout of the server bounds each write instead of
+// the whole response.
+type streamWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (w streamWriter) Write(b []byte) (int, error) {
+	w.rc.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	return w.ResponseWriter.Write(b)
+}
+
+func (w streamWriter) Flush() {
+	w.rc.Flush()
+}
+
+// streamReader extends the read deadline of a large request body before every
+// read, so the ReadTimeout of the server bounds each read instead of the
+// whole upload.
+type streamReader struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+func (r streamReader) Read(b []byte) (int, error) {
+	r.rc.SetReadDeadline(time.Now().Add(serverReadTimeout))
+	return r.ReadCloser.Read(b)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionSplitGap is SessionSplitGap parsed by loadSessionSplit.
+var sessionSplitGap time.Duration
+
+// loadSessionSplit checks the session splitting settings.
+func loadSessionSplit(cfg Cfg) error {
+	if cfg.SessionSplitGap != "" {
+		gap, err := time.ParseDuration(cfg.SessionSplitGap)
+		if err != nil {
+			return fmt.Errorf("SessionSplitGap: %w", err)
+		}
+		sessionSplitGap = gap
+	}
+	if cfg.SessionSplitDistance < 0 {
+		return fmt.Errorf("SessionSplitDistance must not be negative")
+	}
+	if cfg.AutoSessions && !sessionSplitEnabled() {
+		return fmt.Errorf("AutoSessions needs SessionSplitGap or SessionSplitDistance")
+	}
+	return nil
+}
+
+// sessionSplitEnabled reports whether a gap is configured.
+func sessionSplitEnabled() bool {
+	return sessionSplitGap > 0 || AppConfig.SessionSplitDistance > 0
+}
+
+// splitGap reports whether two consecutive points of a user are separated by
+// more than SessionSplitGap or SessionSplitDistance. Points without a
+// timestamp are only compared by distance.
+func splitGap(prev, p Point) bool {
+	if sessionSplitGap > 0 && prev.Time != 0 && p.Time != 0 && p.Time-prev.Time > sessionSplitGap.Milliseconds() {
+		return true
+	}
+	return AppConfig.SessionSplitDistance > 0 && haversine(prev.Lat, prev.Lon, p.Lat, p.Lon) > AppConfig.SessionSplitDistance
+}
+
+// splitTrack cuts a track at every gap.
+func splitTrack(track []Point) [][]Point {
+	if len(track) == 0 {
+		return nil
+	}
+	var parts [][]Point
+	start := 0
+	for i := 1; i < len(track); i++ {
+		if splitGap(track[i-1], track[i]) {
+			parts = append(parts, track[start:i])
+			start = i
+		}
+	}
+	return append(parts, track[start:])
+}
+
+// liveSessions assigns the sessions of the points received live and in
+// batches.
+var liveSessions = newSessionAssigner()
+
+// sessionAssigner gives the points sent without session (session "0") the
+// session of the previous point of their user, or a new session after a gap.
+// It remembers the last point and the highest session of every user, so only
+// the first point of a user is looked up in the store and a batch is split
+// like the same points sent one by one. The points of a user are assigned one
+// at a time, so two of them arriving together cannot both start a session.
+type sessionAssigner struct {
+	mu    sync.Mutex
+	users map[string]*userSessions
+}
+
+// userSessions is what a sessionAssigner knows of a user, guarded by its own
+// lock.
+type userSessions struct {
+	sync.Mutex
+	loaded     bool
+	last       *Point
+	maxSession int64
+}
+
+func newSessionAssigner() *sessionAssigner {
+	return &sessionAssigner{users: make(map[string]*userSessions)}
+}
+
+// user returns the state of a user, created on first use.
+func (a *sessionAssigner) user(user string) *userSessions {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[user]
+	if !ok {
+		u = &userSessions{}
+		a.users[user] = u
+	}
+	return u
+}
+
+// forget drops what is known of a user, or of every user when user is empty,
+// after their points were changed another way than through assign.
+func (a *sessionAssigner) forget(user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if user == "" {
+		a.users = make(map[string]*userSessions)
+		return
+	}
+	delete(a.users, user)
+}
+
+// assign sets the session of a point when AutoSessions is enabled.
+func (a *sessionAssigner) assign(p *Point) error {
+	if !AppConfig.AutoSessions {
+		return nil
+	}
+
+	u := a.user(p.User)
+	u.Lock()
+	defer u.Unlock()
+	if !u.loaded {
+		last, err := store.LastPosition(p.User, "0")
+		if err != nil {
+			return err
+		}
+		max, err := store.MaxSession(p.User)
+		if err != nil {
+			return err
+		}
+		u.last, u.maxSession, u.loaded = last, max, true
+	}
+
+	if p.Session == "0" {
+		if u.last == nil || splitGap(*u.last, *p) {
+			u.maxSession++
+			p.Session = strconv.FormatInt(u.maxSession, 10)
+		} else {
+			p.Session = u.last.Session
+		}
+	}
+	if n, err := strconv.ParseInt(p.Session, 10, 64); err == nil && n > u.maxSession {
+		u.maxSession = n
+	}
+	last := *p
+	u.last = &last
+	return nil
+}
+
+// splitResult describes how a session was split.
+type splitResult struct {
+	User     string
+	Points   int
+	Sessions []string // the sessions the points are in, the first one unchanged
+}
+
+// splitSession re-segments the stored points of a session like AutoSessions
+// does for new points: the first part stays in the session, every following
+// part is moved to the session after last, the highest session of the user,
+// which is advanced. Several sessions of a user can so be split in a row,
+// even in a dry run.
+func splitSession(user, session string, last *int64, dryRun bool) (splitResult, error) {
+	result := splitResult{User: user, Sessions: []string{session}}
+
+	points, err := store.FetchPoints(PointQuery{User: user, Session: session})
+	if err != nil {
+		return result, err
+	}
+	result.Points = len(points)
+
+	parts := splitTrack(points)
+	if len(parts) < 2 {
+		return result, nil
+	}
+	for _, part := range parts[1:] {
+		*last++
+		moved := strconv.FormatInt(*last, 10)
+		result.Sessions = append(result.Sessions, moved)
+		if dryRun {
+			continue
+		}
+
+		ids := make([]int, len(part))
+		for i, p := range part {
+			ids[i] = p.ID
+		}
+		if err := store.MovePoints(ids, moved); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultShareExpiry is used when a share is created without expiry.
+const defaultShareExpiry = 24 * time.Hour
+
+var errShareRequired = errors.New("missing or expired share")
+
+// Share gives access to the map of one user, or of one of their sessions,
+// until it expires or is revoked. Only the hash of its token is stored.
+type Share struct {
+	ID        int64  `json:"id"`
+	User      string `json:"user"`
+	Session   string `json:"session,omitempty"` // empty for every session
+	LiveOnly  bool   `json:"live_only"`         // no history, only the current position
+	From      int64  `json:"from,omitempty"`    // Unix milliseconds, 0 for no lower bound
+	Until     int64  `json:"until,omitempty"`   // Unix milliseconds, 0 for no upper bound
+	TokenHash string `json:"-"`
+	CreatedAt int64  `json:"created_at"` // Unix milliseconds
+	ExpiresAt int64  `json:"expires_at"` // Unix milliseconds
+	RevokedAt int64  `json:"revoked_at,omitempty"`
+}
+
+// newShare is the answer to a share creation, the only one with the token.
+type newShare struct {
+	Share
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// active reports whether the share can still be used.
+func (s *Share) active(now time.Time) bool {
+	return s.RevokedAt == 0 && now.UnixMilli() < s.ExpiresAt
+}
+
+// allows reports whether a point with the given time is inside the time
+// window of the share. Points without a time are judged by the current time.
+func (s *Share) allows(ms int64) bool {
+	if ms == 0 {
+		ms = time.Now().UnixMilli()
+	}
+	return (s.From == 0 || ms >= s.From) && (s.Until == 0 || ms <= s.Until)
+}
+
+// eventSession returns the session of the share in the form used by the
+// SSE stream, where "0" means every session.
+func (s *Share) eventSession() string {
+	if s.Session == "" {
+		return "0"
+	}
+	return s.Session
+}
+
+// pointQuery returns the history shown by the share.
+func (s *Share) pointQuery() PointQuery {
+	return PointQuery{User: s.User, Session: s.Session, From: s.From, Until: s.Until}
+}
+
+// requestShare returns the share of a map request, nil when the request has
+// no share parameter and raw user numbers are allowed. errShareRequired is
+// returned for unknown, revoked and expired shares and, with EnforceShares,
+// for requests without one.
+func requestShare(r *http.Request) (*Share, error) {
+	token := r.URL.Query().Get("share")
+	if token == "" {
+		if AppConfig.EnforceShares {
+			return nil, errShareRequired
+		}
+		return nil, nil
+	}
+
+	share, err := store.ShareByTokenHash(hashKey(token))
+	if err != nil {
+		return nil, err
+	}
+	if share == nil || !share.active(time.Now()) {
+		return nil, errShareRequired
+	}
+	return share, nil
+}
+
+// writeShareError answers a map request whose share was refused. Refused
+// shares look like a missing page, as the map without user does.
+func writeShareError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errShareRequired) {
+		http.NotFound(w, r)
+		return
+	}
+	requestLogger(r).Error("Share query error", "error", err)
+	http.Error(w, "Server Error", http.StatusInternalServerError)
+}
+
+// shareRevoked reports whether a share used by an open stream was revoked.
+// A failing query keeps the stream open.
+func shareRevoked(share *Share) bool {
+	current, err := store.ShareByTokenHash(share.TokenHash)
+	if err != nil {
+		slog.Error("Share query error", "error", err)
+		return false
+	}
+	return current == nil
+}
+
+// sendShareExpired tells the map that its share can no longer be used.
+func sendShareExpired(w http.ResponseWriter) {
+	fmt.Fprint(w, "event: expired\ndata: {}\n\n")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// postShare creates a share. The user can be shared by the admin or by one of
+// the user's devices. Parameters: user, session (optional), expires (a
+// duration, 24h by default), live_only, from and until (RFC 3339).
+func postShare(w http.ResponseWriter, r *http.Request) {
+	user, err := authorizeUser(requestKey(r), r.FormValue("user"))
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	share := Share{
+		User:      user,
+		Session:   r.FormValue("session"),
+		CreatedAt: now.UnixMilli(),
+		ExpiresAt: now.Add(defaultShareExpiry).UnixMilli(),
+	}
+	if user == "" || !isNumeric(user) || len(user) > AppConfig.MaxGetParmLen {
+		http.Error(w, "Invalid user parameter", http.StatusBadRequest)
+		return
+	}
+	if share.Session != "" && (!isNumeric(share.Session) || len(share.Session) > AppConfig.MaxGetParmLen) {
+		http.Error(w, "Invalid session parameter", http.StatusBadRequest)
+		return
+	}
+	if v := r.FormValue("expires"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid expires parameter, use a duration like 2h", http.StatusBadRequest)
+			return
+		}
+		share.ExpiresAt = now.Add(d).UnixMilli()
+	}
+	if v := r.FormValue("live_only"); v != "" {
+		if share.LiveOnly, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid live_only parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, bound := range []struct {
+		name  string
+		value *int64
+	}{{"from", &share.From}, {"until", &share.Until}} {
+		if v := r.FormValue(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid "+bound.name+" parameter, use RFC 3339", http.StatusBadRequest)
+				return
+			}
+			*bound.value = t.UnixMilli()
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		requestLogger(r).Error("Share token error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	share.TokenHash = hashKey(token)
+	if share.ID, err = store.AddShare(share); err != nil {
+		requestLogger(r).Error("Share insert error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newShare{Share: share, Token: token, URL: "/?share=" + token})
+}
+
+// getShares lists the shares that are neither expired nor revoked.
+func getShares(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	shares, err := store.Shares(time.Now().UnixMilli())
+	if err != nil {
+		requestLogger(r).Error("Share query error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shares)
+}
+
+// deleteShare revokes a share, open live maps are closed at the next
+// keep-alive.
+func deleteShare(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid share id", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := store.RevokeShare(id, time.Now().UnixMilli())
+	if err != nil {
+		requestLogger(r).Error("Share revoke error", "error", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shareConfig is the configuration of the share tests, keep-alives every
+// keepAlive.
+func shareConfig(keepAlive string) Cfg {
+	return Cfg{MaxGetParmLen: 20, MaxShowPoint: "100", EventRefreshTime: keepAlive}
+}
+
+// addTestShare stores a share of user 1 and returns its token. The share
+// expires in an hour unless ExpiresAt is set.
+func addTestShare(t *testing.T, token string, sh Share) string {
+	sh.User = "1"
+	sh.TokenHash = hashKey(token)
+	sh.CreatedAt = time.Now().UnixMilli()
+	if sh.ExpiresAt == 0 {
+		sh.ExpiresAt = time.Now().Add(time.Hour).UnixMilli()
+	}
+	id, err := store.AddShare(sh)
+	must(t, err)
+	if sh.RevokedAt != 0 {
+		_, err := store.RevokeShare(id, sh.RevokedAt)
+		must(t, err)
+	}
+	return token
+}
+
+// sharedMap returns the status and the page of the map of a share.
+func sharedMap(token string) (int, string) {
+	w := httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest(http.MethodGet, "/?share="+token, nil))
+	return w.Code, w.Body.String()
+}
+
+// openSharedStream opens the event stream of a share.
+func openSharedStream(t *testing.T, token string) *http.Response {
+	srv := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	t.Cleanup(srv.Close)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL + "/events?share=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// nextEvent returns the name of the next event of a stream, skipping the
+// keep-alives.
+func nextEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), "event: "); ok {
+			return name
+		}
+	}
+}
+
+func TestShareRefused(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, shareConfig("1h"))
+	expired := addTestShare(t, "expired", Share{ExpiresAt: time.Now().Add(-time.Minute).UnixMilli()})
+	revoked := addTestShare(t, "revoked", Share{RevokedAt: time.Now().UnixMilli()})
+
+	for _, token := range []string{expired, revoked, "unknown"} {
+		if status, _ := sharedMap(token); status != http.StatusNotFound {
+			t.Errorf("map of share %s: status %d, want 404", token, status)
+		}
+		if resp := openSharedStream(t, token); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("stream of share %s: status %d, want 404", token, resp.StatusCode)
+		}
+	}
+}
+
+func TestShareMapHistory(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, shareConfig("1h"))
+	_, err := store.InsertPoints([]Point{
+		{Lat: 45.111, Lon: 9, Time: 1000, User: "1", Session: "1"},
+		{Lat: 45.222, Lon: 9, Time: 5000, User: "1", Session: "1"},
+		{Lat: 45.333, Lon: 9, Time: 9000, User: "1", Session: "1"},
+	})
+	must(t, err)
+	window := addTestShare(t, "window", Share{From: 2000, Until: 8000})
+	liveOnly := addTestShare(t, "live", Share{LiveOnly: true})
+
+	status, page := sharedMap(window)
+	if status != http.StatusOK {
+		t.Fatalf("map of the window share: status %d", status)
+	}
+	if strings.Contains(page, "45.111") || !strings.Contains(page, "45.222") || strings.Contains(page, "45.333") {
+		t.Error("map of the window share does not show only the points of the window")
+	}
+
+	status, page = sharedMap(liveOnly)
+	if status != http.StatusOK {
+		t.Fatalf("map of the live only share: status %d", status)
+	}
+	if strings.Contains(page, "45.111") || strings.Contains(page, "45.222") || strings.Contains(page, "45.333") {
+		t.Error("map of the live only share shows the history")
+	}
+}
+
+func TestShareStreamExpires(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, shareConfig("1h"))
+	_, err := store.InsertPoints([]Point{{Lat: 45.2, Lon: 9, Time: 5000, User: "1", Session: "1"}})
+	must(t, err)
+	soon := func() int64 { return time.Now().Add(300 * time.Millisecond).UnixMilli() }
+
+	// The last position is sent only when it is inside the window
+	inside := addTestShare(t, "inside", Share{From: 2000, Until: 8000, ExpiresAt: soon()})
+	events := bufio.NewReader(openSharedStream(t, inside).Body)
+	if ev := nextEvent(t, events); ev != "location" {
+		t.Errorf("first event of the window share = %s, want location", ev)
+	}
+	if ev := nextEvent(t, events); ev != "expired" {
+		t.Errorf("event of the window share = %s, want expired", ev)
+	}
+	if _, err := io.ReadAll(events); err != nil {
+		t.Errorf("stream of the expired share not closed: %v", err)
+	}
+
+	outside := addTestShare(t, "outside", Share{From: 6000, ExpiresAt: soon()})
+	events = bufio.NewReader(openSharedStream(t, outside).Body)
+	if ev := nextEvent(t, events); ev != "expired" {
+		t.Errorf("first event of the share after the last point = %s, want expired", ev)
+	}
+}
+
+func TestShareStreamRevoked(t *testing.T) {
+	useTestStore(t)
+	useTestConfig(t, shareConfig("50ms"))
+	_, err := store.InsertPoints([]Point{{Lat: 45.2, Lon: 9, Time: 5000, User: "1", Session: "1"}})
+	must(t, err)
+	token := addTestShare(t, "revoked", Share{})
+
+	events := bufio.NewReader(openSharedStream(t, token).Body)
+	if ev := nextEvent(t, events); ev != "location" {
+		t.Fatalf("first event = %s, want location", ev)
+	}
+	shares, err := store.Shares(time.Now().UnixMilli())
+	must(t, err)
+	revoked, err := store.RevokeShare(shares[0].ID, time.Now().UnixMilli())
+	must(t, err)
+	if !revoked {
+		t.Fatal("share not revoked")
+	}
+	if ev := nextEvent(t, events); ev != "expired" {
+		t.Errorf("event after the revocation = %s, want expired", ev)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+const (
+	// movingSpeed is the speed in m/s above which the time between two
+	// points counts as moving time, below it GPS noise is taken for a stop.
+	movingSpeed = 0.5
+	// maxPlausibleSpeed is the speed in m/s, 360 km/h, above which the move
+	// between two points is taken for a jump of the position and not used
+	// for the maximum speed.
+	maxPlausibleSpeed = 100
+	// statsCacheSize is the number of sessions whose statistics are cached.
+	statsCacheSize = 1000
+)
+
+// SessionStats summarizes the stored points of a session. Speeds are computed
+// from the positions and times, points without a timestamp only count for
+// the distance, the bounds and the elevation. The maximum speed leaves out
+// the moves within the accuracy of the points and the implausible ones.
+type SessionStats struct {
+	User           string  `json:"user"`
+	Session        string  `json:"session"`
+	Points         int     `json:"points"`
+	Distance       float64 `json:"distance_m"`
+	Start          int64   `json:"start,omitempty"` // Unix milliseconds
+	End            int64   `json:"end,omitempty"`   // Unix milliseconds
+	Elapsed        float64 `json:"elapsed_s"`
+	MovingTime     float64 `json:"moving_time_s"`
+	AvgSpeed       float64 `json:"avg_speed_kmh"`
+	AvgMovingSpeed float64 `json:"avg_moving_speed_kmh"`
+	MaxSpeed       float64 `json:"max_speed_kmh"`
+	Ascent         float64 `json:"ascent_m"`
+	Descent        float64 `json:"descent_m"`
+	Bounds         *Bounds `json:"bounds"`
+}
+
+// Bounds is the bounding box of a set of points.
+type Bounds struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// computeSessionStats walks the points of a session, oldest first. An
+// altitude of 0 is taken for a tracker that sent none and is not used for
+// the ascent and descent.
+func computeSessionStats(user, session string, points []Point) SessionStats {
+	s := SessionStats{User: user, Session: session, Points: len(points)}
+
+	var maxSpeed float64
+	for i, p := range points {
+		if s.Bounds == nil {
+			s.Bounds = &Bounds{MinLat: p.Lat, MinLon: p.Lon, MaxLat: p.Lat, MaxLon: p.Lon}
+		} else {
+			s.Bounds.MinLat = min(s.Bounds.MinLat, p.Lat)
+			s.Bounds.MinLon = min(s.Bounds.MinLon, p.Lon)
+			s.Bounds.MaxLat = max(s.Bounds.MaxLat, p.Lat)
+			s.Bounds.MaxLon = max(s.Bounds.MaxLon, p.Lon)
+		}
+		if p.Time != 0 {
+			if s.Start == 0 || p.Time < s.Start {
+				s.Start = p.Time
+			}
+			s.End = max(s.End, p.Time)
+		}
+		if i == 0 {
+			continue
+		}
+
+		prev := points[i-1]
+		d := haversine(prev.Lat, prev.Lon, p.Lat, p.Lon)
+		s.Distance += d
+		if prev.Time != 0 && p.Time > prev.Time {
+			dt := float64(p.Time-prev.Time) / 1000
+			speed := d / dt
+			if speed >= movingSpeed {
+				s.MovingTime += dt
+			}
+			if d > max(prev.Acc, p.Acc) && speed <= maxPlausibleSpeed {
+				maxSpeed = max(maxSpeed, speed)
+			}
+		}
+		if prev.Alt != 0 && p.Alt != 0 {
+			if climb := p.Alt - prev.Alt; climb > 0 {
+				s.Ascent += climb
+			} else {
+				s.Descent -= climb
+			}
+		}
+	}
+
+	if s.Start != 0 {
+		s.Elapsed = float64(s.End-s.Start) / 1000
+	}
+	if s.Elapsed > 0 {
+		s.AvgSpeed = s.Distance / s.Elapsed * 3.6
+	}
+	if s.MovingTime > 0 {
+		s.AvgMovingSpeed = s.Distance / s.MovingTime * 3.6
+	}
+	s.MaxSpeed = maxSpeed * 3.6
+	return s
+}
+
+// sessionKey identifies a session of a user.
+type sessionKey struct {
+	user    string
+	session string
+}
+
+// statsCache keeps the statistics of the most recently used sessions until
+// one of their points is added or deleted. Every invalidation bumps the
+// generation of its session, so statistics computed while the points of the
+// session changed are not cached. The generations of at most 4 × size
+// sessions are kept: beyond, they are dropped and the epoch is bumped, which
+// only refuses the statistics being computed at that time.
+type statsCache struct {
+	mu    sync.Mutex
+	epoch uint64
+	gens  map[sessionKey]uint64
+	size  int
+	order *list.List // of SessionStats, most recently used first
+	stats map[sessionKey]*list.Element
+}
+
+// statsGen is the generation of a session's points when its statistics are
+// computed.
+type statsGen struct {
+	epoch uint64
+	gen   uint64
+}
+
+var sessionStats = newStatsCache(statsCacheSize)
+
+func newStatsCache(size int) *statsCache {
+	return &statsCache{gens: make(map[sessionKey]uint64), size: size, order: list.New(), stats: make(map[sessionKey]*list.Element)}
+}
+
+// gen returns the current generation of a session.
+func (c *statsCache) gen(key sessionKey) statsGen {
+	return statsGen{c.epoch, c.gens[key]}
+}
+
+// get returns the cached statistics of a session and the generation to pass
+// to put when there are none.
+func (c *statsCache) get(user, session string) (SessionStats, statsGen, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := sessionKey{user, session}
+	e, ok := c.stats[key]
+	if !ok {
+		return SessionStats{}, c.gen(key), false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(SessionStats), c.gen(key), true
+}
+
+// put caches the statistics of a session, dropping the least recently used
+// ones beyond the size of the cache.
+func (c *statsCache) put(s SessionStats, gen statsGen) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := sessionKey{s.User, s.Session}
+	if gen != c.gen(key) {
+		return
+	}
+	if e, ok := c.stats[key]; ok {
+		e.Value = s
+		c.order.MoveToFront(e)
+		return
+	}
+	c.stats[key] = c.order.PushFront(s)
+	for c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Back()).(SessionStats)
+		delete(c.stats, sessionKey{oldest.User, oldest.Session})
+	}
+}
+
+// invalidate drops the statistics of a session.
+func (c *statsCache) invalidate(user, session string) {
+	c.mu.Lock()
+	key := sessionKey{user, session}
+	if _, ok := c.gens[key]; !ok && len(c.gens) >= 4*c.size {
+		c.epoch++
+		c.gens = make(map[sessionKey]uint64)
+	}
+	c.gens[key]++
+	if e, ok := c.stats[key]; ok {
+		c.order.Remove(e)
+		delete(c.stats, key)
+	}
+	c.mu.Unlock()
+}
+
+// reset drops the statistics of every session.
+func (c *statsCache) reset() {
+	c.mu.Lock()
+	c.epoch++
+	c.gens = make(map[sessionKey]uint64)
+	c.order.Init()
+	c.stats = make(map[sessionKey]*list.Element)
+	c.mu.Unlock()
+}
+
+// getSessionStats answers /api/sessions/{user}/{session}/stats. Like
+// /getusersession it needs the key of the user or one of their devices.
+func getSessionStats(w http.ResponseWriter, r *http.Request) {
+	user, err := authorizeUser(requestKey(r), r.PathValue("user"))
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	session := r.PathValue("session")
+	if user == "" || !isNumeric(user) || len(user) > AppConfig.MaxGetParmLen ||
+		!isNumeric(session) || len(session) > AppConfig.MaxGetParmLen {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	stats, gen, ok := sessionStats.get(user, session)
+	if !ok {
+		points, err := store.FetchPoints(PointQuery{User: user, Session: session})
+		if err != nil {
+			requestLogger(r).Error("Error querying database", "error", err)
+			http.Error(w, "Query error", http.StatusInternalServerError)
+			return
+		}
+		stats = computeSessionStats(user, session, points)
+		sessionStats.put(stats, gen)
+	}
+	if stats.Points == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
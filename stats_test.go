@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestSessionStatsMaxSpeed(t *testing.T) {
+	// 0.001° of latitude is about 111 m
+	points := []Point{
+		{Lat: 45, Lon: 9, Time: 1_000},
+		{Lat: 45.001, Lon: 9, Time: 11_000}, // 11 m/s
+		// A jump of 11 km in 10s
+		{Lat: 45.101, Lon: 9, Time: 21_000},
+		{Lat: 45.001, Lon: 9, Time: 31_000},
+		// 20 m in 1s, within the 25 m accuracy
+		{Lat: 45.00118, Lon: 9, Time: 32_000, Acc: 25},
+	}
+	stats := computeSessionStats("1", "1", points)
+	if want := 111.2 / 10 * 3.6; math.Abs(stats.MaxSpeed-want) > 1 {
+		t.Errorf("MaxSpeed = %.1f km/h, want %.1f", stats.MaxSpeed, want)
+	}
+}
+
+func TestStatsCacheLRU(t *testing.T) {
+	c := newStatsCache(2)
+	for _, session := range []string{"1", "2"} {
+		_, gen, _ := c.get("1", session)
+		c.put(SessionStats{User: "1", Session: session}, gen)
+	}
+	// Using session 1 makes session 2 the least recently used
+	if _, _, ok := c.get("1", "1"); !ok {
+		t.Fatal("session 1 not cached")
+	}
+	_, gen, _ := c.get("1", "3")
+	c.put(SessionStats{User: "1", Session: "3"}, gen)
+
+	for session, want := range map[string]bool{"1": true, "2": false, "3": true} {
+		if _, _, ok := c.get("1", session); ok != want {
+			t.Errorf("session %s cached = %v, want %v", session, ok, want)
+		}
+	}
+
+	// Statistics computed before an invalidation of their session are not
+	// cached, the invalidation of another session does not matter
+	_, gen, _ = c.get("1", "2")
+	c.invalidate("1", "3")
+	c.put(SessionStats{User: "1", Session: "2"}, gen)
+	if _, _, ok := c.get("1", "2"); !ok {
+		t.Error("statistics not cached after another session changed")
+	}
+	if _, _, ok := c.get("1", "3"); ok {
+		t.Error("invalidated statistics still cached")
+	}
+	_, gen, _ = c.get("1", "3")
+	c.invalidate("1", "3")
+	c.put(SessionStats{User: "1", Session: "3"}, gen)
+	if _, _, ok := c.get("1", "3"); ok {
+		t.Error("stale statistics cached")
+	}
+
+	// Dropping the generations beyond 4 × size refuses the statistics being
+	// computed
+	_, gen, _ = c.get("1", "4")
+	for i := range 8 {
+		c.invalidate("2", strconv.Itoa(i))
+	}
+	c.put(SessionStats{User: "1", Session: "4"}, gen)
+	if _, _, ok := c.get("1", "4"); ok {
+		t.Error("statistics cached across dropped generations")
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Store is the storage backend of the points. SQLite is the default,
+// PostgreSQL can be selected in config.yaml for larger deployments.
+type Store interface {
+	// InsertPoint stores a single validated point.
+	InsertPoint(p Point) error
+	// InsertPoints stores the points in one transaction, skipping the
+	// duplicates of a stored point, see PointExists. It returns for each point
+	// whether it was inserted.
+	InsertPoints(points []Point) ([]bool, error)
+	// PointExists reports whether a point with the same user, session and
+	// timestamp is stored, or one with the same values when p has no
+	// timestamp. With anySession the session is not compared.
+	PointExists(p Point, anySession bool) (bool, error)
+	// LastPosition returns the last point of a user, in a session unless
+	// session is "0", or nil when there is none.
+	LastPosition(user, session string) (*Point, error)
+	// LastPositions returns the last point of every user, in a session unless
+	// session is "0".
+	LastPositions(session string) ([]Point, error)
+	// Sessions returns the sessions of a user.
+	Sessions(user string) ([]string, error)
+	// MaxSession returns the highest numeric session of a user, 0 if none.
+	MaxSession(user string) (int64, error)
+	// FetchPoints returns the newest points selected by q, ordered oldest first.
+	FetchPoints(q PointQuery) ([]Point, error)
+	// FetchTrack returns every point of a user's session in insertion order.
+	FetchTrack(user, session string) ([]Point, error)
+	// DeleteAll removes every point.
+	DeleteAll() error
+	// MovePoints moves points, given by id, to another session.
+	MovePoints(ids []int, session string) error
+	// DeleteSession removes the points of a user's session.
+	DeleteSession(user, session string) error
+	// DeletePointsBefore removes the points of a user older than before, in
+	// Unix milliseconds, and returns how many. Points without timestamp are
+	// kept.
+	DeletePointsBefore(user string, before int64) (int64, error)
+	// DownsamplePoints keeps, of the points of a user older than before, the
+	// first one of each session in every interval of milliseconds. It returns
+	// how many points were removed.
+	DownsamplePoints(user string, before, interval int64) (int64, error)
+	// Vacuum returns the space of the deleted rows to the system. A SQLite
+	// database created without incremental auto-vacuum is only rewritten to
+	// enable it when rewrite is set, otherwise its free pages are reused.
+	Vacuum(rewrite bool) error
+
+	// AddDevice registers a device and returns its id.
+	AddDevice(d Device) (int64, error)
+	// DeviceByTokenHash returns the active device with the given token hash,
+	// or nil when there is none.
+	DeviceByTokenHash(hash string) (*Device, error)
+	// DeviceByName returns the newest active device with the given name, or
+	// nil when there is none.
+	DeviceByName(name string) (*Device, error)
+	// HasDevices reports whether a user has an active device.
+	HasDevices(user string) (bool, error)
+	// Devices returns every device, revoked ones included.
+	Devices() ([]Device, error)
+	// RevokeDevice marks an active device as revoked at the given time and
+	// reports whether it was found.
+	RevokeDevice(id int64, at int64) (bool, error)
+
+	// AddShare stores a share and returns its id.
+	AddShare(sh Share) (int64, error)
+	// ShareByTokenHash returns the unrevoked share with the given token hash,
+	// or nil when there is none. Expiry is left to the caller.
+	ShareByTokenHash(hash string) (*Share, error)
+	// Shares returns the shares neither revoked nor expired at now.
+	Shares(now int64) ([]Share, error)
+	// RevokeShare marks a share as revoked at the given time and reports
+	// whether an unrevoked one was found.
+	RevokeShare(id int64, at int64) (bool, error)
+
+	// Geofences returns every geofence.
+	Geofences() ([]Geofence, error)
+	// AddGeofence stores a geofence and returns its id.
+	AddGeofence(g Geofence) (int64, error)
+	// UpdateGeofence replaces a geofence and reports whether it was found.
+	UpdateGeofence(g Geofence) (bool, error)
+	// DeleteGeofence removes a geofence and reports whether it was found.
+	DeleteGeofence(id int64) (bool, error)
+	// AddGeofenceEvent records a transition and returns its id.
+	AddGeofenceEvent(e GeofenceEvent) (int64, error)
+	// LastGeofenceEvent returns the type of the last transition of a user for
+	// a geofence, "" when there is none.
+	LastGeofenceEvent(geofenceID int64, user string) (string, error)
+	// GeofenceEvents returns the newest transitions, of every user when user
+	// is empty.
+	GeofenceEvents(user string, limit int) ([]GeofenceEvent, error)
+
+	// AddWebhookDelivery queues a webhook delivery and returns its id.
+	AddWebhookDelivery(d WebhookDelivery) (int64, error)
+	// DueWebhookDeliveries returns the oldest deliveries of a webhook due at
+	// now.
+	DueWebhookDeliveries(webhook string, now int64, limit int) ([]WebhookDelivery, error)
+	// QueuedWebhooks returns the names of the webhooks with queued deliveries.
+	QueuedWebhooks() ([]string, error)
+	// DeleteWebhookDeliveries removes the deliveries of a webhook and returns
+	// how many there were.
+	DeleteWebhookDeliveries(webhook string) (int64, error)
+	// RescheduleWebhookDelivery records a failed attempt and the time of the
+	// next one.
+	RescheduleWebhookDelivery(id int64, attempts int, next int64) error
+	// DeleteWebhookDelivery removes a delivery from the queue.
+	DeleteWebhookDelivery(id int64) error
+
+	Close() error
+}
+
+// PointQuery selects the points returned by FetchPoints.
+type PointQuery struct {
+	User    string // empty for every user
+	Session string // empty for every session, only used with User
+	From    int64  // Unix milliseconds, 0 for no lower bound
+	Until   int64  // Unix milliseconds, 0 for no upper bound
+	Limit   int    // newest points returned, 0 for all
+}
+
+// Supported values of the Database setting
+const (
+	databaseSQLite   = "sqlite"
+	databasePostgres = "postgres"
+)
+
+var store Store
+
+// OpenStore opens the backend selected in the configuration and brings its
+// schema up to date.
+func OpenStore() (Store, error) {
+	switch AppConfig.Database {
+	case "", databaseSQLite:
+		path := AppConfig.SQLitePath
+		if path == "" {
+			path = "sqlite-database.db"
+		}
+		return OpenSQLiteStore(path)
+	case databasePostgres:
+		return OpenPostgresStore(AppConfig.PostgresDSN)
+	default:
+		return nil, fmt.Errorf("unknown Database %q, use %q or %q", AppConfig.Database, databaseSQLite, databasePostgres)
+	}
+}
+
+// A migration upgrades the schema by one version. Migrations run in order,
+// each one in its own transaction, and are recorded in schema_version.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrate applies the migrations of a dialect newer than the version
+// recorded in schema_version. When the dialect has a migration lock, it is
+// held on a connection of its own until the migrations are done, and other
+// instances starting at the same time wait for it.
+func migrate(db *sql.DB, d *dialect) error {
+	if d.lockMigrations != "" {
+		ctx := context.Background()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, d.lockMigrations); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, d.unlockMigrations)
+	}
+
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_version (
+            VERSION INTEGER NOT NULL PRIMARY KEY,
+            NAME TEXT NOT NULL,
+            APPLIED_AT BIGINT NOT NULL
+        );
+    `)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(VERSION), 0) FROM schema_version").Scan(&current); err != nil {
+		return err
+	}
+
+	for _, m := range d.migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := runMigration(db, m, d.query(d.insertVersion)); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		slog.Info("Migration applied", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+func runMigration(db *sql.DB, m migration, insertVersion string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(insertVersion, m.version, m.name, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPoint reads a row selecting id, lat, lon, alt, speed, time, bearing,
+// hdop, acc, user and session, in this order.
+func scanPoint(s scanner) (Point, error) {
+	var p Point
+	err := s.Scan(&p.ID, &p.Lat, &p.Lon, &p.Alt, &p.Speed, &p.Time, &p.Bearing, &p.Hdop, &p.Acc, &p.User, &p.Session)
+	return p, err
+}
+
+// scanPoints reads every row with scanPoint and closes the rows.
+func scanPoints(rows *sql.Rows) ([]Point, error) {
+	defer rows.Close()
+
+	points := make([]Point, 0)
+	for rows.Next() {
+		p, err := scanPoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// scanDevice reads the device of a single row query like scanDevices, nil
+// when there is none.
+func scanDevice(row *sql.Row) (*Device, error) {
+	var d Device
+	err := row.Scan(&d.ID, &d.User, &d.Name, &d.TokenHash, &d.CreatedAt, &d.RevokedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// scanDevices reads rows selecting id, user, name, token hash, creation and
+// revocation time, and closes the rows.
+func scanDevices(rows *sql.Rows) ([]Device, error) {
+	defer rows.Close()
+
+	devices := make([]Device, 0)
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.User, &d.Name, &d.TokenHash, &d.CreatedAt, &d.RevokedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// scanShare reads a row selecting the share columns, see shareColumns.
+func scanShare(s scanner) (Share, error) {
+	var sh Share
+	err := s.Scan(&sh.ID, &sh.User, &sh.Session, &sh.LiveOnly, &sh.From, &sh.Until, &sh.TokenHash, &sh.CreatedAt, &sh.ExpiresAt, &sh.RevokedAt)
+	return sh, err
+}
+
+// scanShares reads every row with scanShare and closes the rows.
+func scanShares(rows *sql.Rows) ([]Share, error) {
+	defer rows.Close()
+
+	shares := make([]Share, 0)
+	for rows.Next() {
+		sh, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, sh)
+	}
+	return shares, rows.Err()
+}
+
+// scanGeofences reads rows selecting id, user, name, type, lat, lon, radius,
+// polygon as JSON and creation time, and closes the rows.
+func scanGeofences(rows *sql.Rows) ([]Geofence, error) {
+	defer rows.Close()
+
+	list := make([]Geofence, 0)
+	for rows.Next() {
+		var g Geofence
+		var polygon string
+		if err := rows.Scan(&g.ID, &g.User, &g.Name, &g.Type, &g.Lat, &g.Lon, &g.Radius, &polygon, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		if polygon != "" {
+			if err := json.Unmarshal([]byte(polygon), &g.Polygon); err != nil {
+				return nil, fmt.Errorf("geofence %d: %w", g.ID, err)
+			}
+		}
+		list = append(list, g)
+	}
+	return list, rows.Err()
+}
+
+// polygonJSON encodes the vertices of a geofence for its POLYGON column.
+func polygonJSON(g Geofence) string {
+	if len(g.Polygon) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(g.Polygon)
+	return string(b)
+}
+
+// scanGeofenceEvents reads rows selecting id, geofence id, geofence name,
+// user, session, type, lat, lon and time, and closes the rows.
+func scanGeofenceEvents(rows *sql.Rows) ([]GeofenceEvent, error) {
+	defer rows.Close()
+
+	events := make([]GeofenceEvent, 0)
+	for rows.Next() {
+		var e GeofenceEvent
+		if err := rows.Scan(&e.ID, &e.GeofenceID, &e.Geofence, &e.User, &e.Session, &e.Type, &e.Lat, &e.Lon, &e.Time); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// scanWebhookDeliveries reads rows selecting id, webhook, event, body,
+// attempts, next attempt and creation time, and closes the rows.
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var body string
+		if err := rows.Scan(&d.ID, &d.Webhook, &d.Event, &body, &d.Attempts, &d.NextAttempt, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Body = []byte(body)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// reversePoints inverts the order of the points in place.
+func reversePoints(points []Point) {
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+}
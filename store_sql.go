@@ -0,0 +1,636 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dialect holds what differs between the databases behind sqlStore. The
+// queries are written with ? placeholders and {name} tokens for the
+// identifiers that are not the same in every schema.
+type dialect struct {
+	driver string
+	// names replaces the {name} tokens of the queries
+	names *strings.Replacer
+	// numbered uses the $1, $2... placeholders instead of ?
+	numbered bool
+	// returning reads the id of inserted rows with RETURNING instead of
+	// LastInsertId
+	returning bool
+	// maxSession is the query of MaxSession, the sessions are cast to a
+	// number differently
+	maxSession string
+	// migrations lists the schema changes, insertVersion records one in
+	// schema_version
+	migrations    []migration
+	insertVersion string
+	// lockMigrations and unlockMigrations run around the migrations on a
+	// connection of their own, so instances sharing a database do not apply
+	// them twice
+	lockMigrations   string
+	unlockMigrations string
+	// vacuum returns the space of the deleted rows to the system, rewriting
+	// the database if needed when rewrite is set
+	vacuum func(db *sql.DB, rewrite bool) error
+}
+
+// query returns a query written for sqlStore in the SQL of the database.
+func (d *dialect) query(q string) string {
+	q = d.names.Replace(q)
+	if !d.numbered {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// returningID is the suffix of the inserts whose id is read.
+func (d *dialect) returningID() string {
+	if d.returning {
+		return " RETURNING ID"
+	}
+	return ""
+}
+
+// pointColumns is the column list of the inserted points, read by scanPoint
+// after the ID.
+const pointColumns = "LAT, LON, ALT, SPEED, TIME, BEARING, HDOP, ACC, {user}, {session}"
+
+// shareColumns is the column list read by scanShare.
+const shareColumns = "ID, {user}, {session}, LIVE_ONLY, TIME_FROM, TIME_UNTIL, TOKEN_HASH, CREATED_AT, EXPIRES_AT, REVOKED_AT"
+
+// sqlStore implements Store with prepared statements on a database/sql
+// driver, SQLite or PostgreSQL.
+type sqlStore struct {
+	db      *sql.DB
+	dialect *dialect
+
+	stmtWithUserAndSession *timedStmt
+	stmtWithUserOnly       *timedStmt
+	stmtGetUserSessions    *timedStmt
+	stmtInsertPoint        *timedStmt
+	stmtFetchTrack         *timedStmt
+	stmtLastPositions      *timedStmt
+	stmtLastPositionsBySes *timedStmt
+	stmtPointExists        *timedStmt
+	stmtTimelessExists     *timedStmt
+	stmtMaxSession         *timedStmt
+	stmtDeleteSession      *timedStmt
+	stmtMovePoint          *timedStmt
+	stmtDeleteBefore       *timedStmt
+	stmtDownsample         *timedStmt
+	stmtAddDevice          *timedStmt
+	stmtDeviceByToken      *timedStmt
+	stmtDeviceByName       *timedStmt
+	stmtHasDevices         *timedStmt
+	stmtDevices            *timedStmt
+	stmtRevokeDevice       *timedStmt
+	stmtAddShare           *timedStmt
+	stmtShareByToken       *timedStmt
+	stmtShares             *timedStmt
+	stmtRevokeShare        *timedStmt
+	stmtGeofences          *timedStmt
+	stmtAddGeofence        *timedStmt
+	stmtUpdateGeofence     *timedStmt
+	stmtDeleteGeofence     *timedStmt
+	stmtAddGeofenceEvent   *timedStmt
+	stmtLastGeofenceEvent  *timedStmt
+	stmtGeofenceEvents     *timedStmt
+	stmtAddWebhook         *timedStmt
+	stmtDueWebhooks        *timedStmt
+	stmtRescheduleWebhook  *timedStmt
+	stmtDeleteWebhook      *timedStmt
+	stmtQueuedWebhooks     *timedStmt
+	stmtDeleteWebhookQueue *timedStmt
+}
+
+// openSQLStore connects to a database, applies the pending migrations and
+// prepares the statements.
+func openSQLStore(d *dialect, dsn string) (Store, error) {
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Create the schema or bring databases created by older versions up to date
+	if err := migrate(db, d); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &sqlStore{db: db, dialect: d}
+	if err := s.prepare(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// prepare initializes the prepared statements.
+func (s *sqlStore) prepare() error {
+	returning := s.dialect.returningID()
+	statements := []struct {
+		stmt  **timedStmt
+		name  string
+		query string
+	}{
+		{&s.stmtWithUserAndSession, "last_position_by_session", "SELECT ID, " + pointColumns + " FROM Points WHERE {user} = ? AND {session} = ? ORDER BY ID DESC LIMIT 1"},
+		{&s.stmtWithUserOnly, "last_position", "SELECT ID, " + pointColumns + " FROM Points WHERE {user} = ? ORDER BY ID DESC LIMIT 1"},
+		{&s.stmtGetUserSessions, "sessions", "SELECT DISTINCT {session} FROM Points WHERE {user} = ?"},
+		{&s.stmtInsertPoint, "insert_point", "INSERT INTO Points(" + pointColumns + ") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+		{&s.stmtFetchTrack, "fetch_track", "SELECT ID, " + pointColumns + " FROM Points WHERE {user} = ? AND {session} = ? ORDER BY ID"},
+		{&s.stmtLastPositions, "last_positions", "SELECT ID, " + pointColumns + " FROM Points WHERE ID IN (SELECT MAX(ID) FROM Points GROUP BY {user}) ORDER BY {user}"},
+		{&s.stmtLastPositionsBySes, "last_positions_by_session", "SELECT ID, " + pointColumns + " FROM Points WHERE ID IN (SELECT MAX(ID) FROM Points WHERE {session} = ? GROUP BY {user}) ORDER BY {user}"},
+		{&s.stmtPointExists, "point_exists", "SELECT 1 FROM Points WHERE {user} = ? AND (? = '' OR {session} = ?) AND TIME = ? LIMIT 1"},
+		{&s.stmtTimelessExists, "timeless_point_exists", "SELECT 1 FROM Points WHERE {user} = ? AND (? = '' OR {session} = ?) AND TIME = 0" +
+			" AND LAT = ? AND LON = ? AND ALT = ? AND SPEED = ? AND BEARING = ? AND HDOP = ? AND ACC = ? LIMIT 1"},
+		{&s.stmtMaxSession, "max_session", s.dialect.maxSession},
+		{&s.stmtDeleteSession, "delete_session", "DELETE FROM Points WHERE {user} = ? AND {session} = ?"},
+		{&s.stmtMovePoint, "move_point", "UPDATE Points SET {session} = ? WHERE ID = ?"},
+		{&s.stmtDeleteBefore, "delete_before", "DELETE FROM Points WHERE {user} = ? AND TIME > 0 AND TIME < ?"},
+		{&s.stmtDownsample, "downsample", "DELETE FROM Points WHERE {user} = ? AND TIME > 0 AND TIME < ? AND ID NOT IN (SELECT MIN(ID) FROM Points WHERE {user} = ? AND TIME > 0 AND TIME < ? GROUP BY {session}, TIME / ?)"},
+		{&s.stmtAddDevice, "add_device", "INSERT INTO Devices({user}, NAME, TOKEN_HASH, CREATED_AT) VALUES(?, ?, ?, ?)" + returning},
+		{&s.stmtDeviceByToken, "device_by_token", "SELECT ID, {user}, NAME, TOKEN_HASH, CREATED_AT, REVOKED_AT FROM Devices WHERE TOKEN_HASH = ? AND REVOKED_AT = 0"},
+		{&s.stmtDeviceByName, "device_by_name", "SELECT ID, {user}, NAME, TOKEN_HASH, CREATED_AT, REVOKED_AT FROM Devices WHERE NAME = ? AND REVOKED_AT = 0 ORDER BY ID DESC LIMIT 1"},
+		{&s.stmtHasDevices, "has_devices", "SELECT 1 FROM Devices WHERE {user} = ? AND REVOKED_AT = 0 LIMIT 1"},
+		{&s.stmtDevices, "devices", "SELECT ID, {user}, NAME, TOKEN_HASH, CREATED_AT, REVOKED_AT FROM Devices ORDER BY ID"},
+		{&s.stmtRevokeDevice, "revoke_device", "UPDATE Devices SET REVOKED_AT = ? WHERE ID = ? AND REVOKED_AT = 0"},
+		{&s.stmtAddShare, "add_share", "INSERT INTO Shares({user}, {session}, LIVE_ONLY, TIME_FROM, TIME_UNTIL, TOKEN_HASH, CREATED_AT, EXPIRES_AT) VALUES(?, ?, ?, ?, ?, ?, ?, ?)" + returning},
+		{&s.stmtShareByToken, "share_by_token", "SELECT " + shareColumns + " FROM Shares WHERE TOKEN_HASH = ? AND REVOKED_AT = 0"},
+		{&s.stmtShares, "shares", "SELECT " + shareColumns + " FROM Shares WHERE REVOKED_AT = 0 AND EXPIRES_AT > ? ORDER BY ID"},
+		{&s.stmtRevokeShare, "revoke_share", "UPDATE Shares SET REVOKED_AT = ? WHERE ID = ? AND REVOKED_AT = 0"},
+		{&s.stmtGeofences, "geofences", "SELECT ID, {user}, NAME, TYPE, LAT, LON, RADIUS, POLYGON, CREATED_AT FROM Geofences ORDER BY ID"},
+		{&s.stmtAddGeofence, "add_geofence", "INSERT INTO Geofences({user}, NAME, TYPE, LAT, LON, RADIUS, POLYGON, CREATED_AT) VALUES(?, ?, ?, ?, ?, ?, ?, ?)" + returning},
+		{&s.stmtUpdateGeofence, "update_geofence", "UPDATE Geofences SET {user} = ?, NAME = ?, TYPE = ?, LAT = ?, LON = ?, RADIUS = ?, POLYGON = ? WHERE ID = ?"},
+		{&s.stmtDeleteGeofence, "delete_geofence", "DELETE FROM Geofences WHERE ID = ?"},
+		{&s.stmtAddGeofenceEvent, "add_geofence_event", "INSERT INTO {GeofenceEvents}(GEOFENCE_ID, GEOFENCE, {user}, {session}, TYPE, LAT, LON, TIME) VALUES(?, ?, ?, ?, ?, ?, ?, ?)" + returning},
+		{&s.stmtLastGeofenceEvent, "last_geofence_event", "SELECT TYPE FROM {GeofenceEvents} WHERE GEOFENCE_ID = ? AND {user} = ? ORDER BY ID DESC LIMIT 1"},
+		{&s.stmtGeofenceEvents, "geofence_events", "SELECT ID, GEOFENCE_ID, GEOFENCE, {user}, {session}, TYPE, LAT, LON, TIME FROM {GeofenceEvents} WHERE ? = '' OR {user} = ? ORDER BY ID DESC LIMIT ?"},
+		{&s.stmtAddWebhook, "add_webhook", "INSERT INTO {WebhookDeliveries}(WEBHOOK, EVENT, BODY, ATTEMPTS, NEXT_ATTEMPT, CREATED_AT) VALUES(?, ?, ?, ?, ?, ?)" + returning},
+		{&s.stmtDueWebhooks, "due_webhooks", "SELECT ID, WEBHOOK, EVENT, BODY, ATTEMPTS, NEXT_ATTEMPT, CREATED_AT FROM {WebhookDeliveries} WHERE WEBHOOK = ? AND NEXT_ATTEMPT <= ? ORDER BY ID LIMIT ?"},
+		{&s.stmtRescheduleWebhook, "reschedule_webhook", "UPDATE {WebhookDeliveries} SET ATTEMPTS = ?, NEXT_ATTEMPT = ? WHERE ID = ?"},
+		{&s.stmtDeleteWebhook, "delete_webhook", "DELETE FROM {WebhookDeliveries} WHERE ID = ?"},
+		{&s.stmtQueuedWebhooks, "queued_webhooks", "SELECT DISTINCT WEBHOOK FROM {WebhookDeliveries} ORDER BY WEBHOOK"},
+		{&s.stmtDeleteWebhookQueue, "delete_webhook_queue", "DELETE FROM {WebhookDeliveries} WHERE WEBHOOK = ?"},
+	}
+	for _, st := range statements {
+		stmt, err := s.db.Prepare(s.dialect.query(st.query))
+		if err != nil {
+			return fmt.Errorf("statement %s: %w", st.name, err)
+		}
+		*st.stmt = &timedStmt{stmt, st.name}
+	}
+	return nil
+}
+
+// insert runs an insert and returns the id of the new row.
+func (s *sqlStore) insert(stmt *timedStmt, args ...any) (int64, error) {
+	if s.dialect.returning {
+		var id int64
+		err := stmt.QueryRow(args...).Scan(&id)
+		return id, err
+	}
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// affected runs a statement and reports whether it changed a row.
+func affected(stmt *timedStmt, args ...any) (bool, error) {
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) InsertPoint(p Point) error {
+	_, err := s.stmtInsertPoint.Exec(p.Lat, p.Lon, p.Alt, p.Speed, p.Time, p.Bearing, p.Hdop, p.Acc, p.User, p.Session)
+	return err
+}
+
+func (s *sqlStore) InsertPoints(points []Point) ([]bool, error) {
+	inserted := make([]bool, len(points))
+	if len(points) == 0 {
+		return inserted, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insert := s.stmtInsertPoint.in(tx)
+	exists, timeless := s.stmtPointExists.in(tx), s.stmtTimelessExists.in(tx)
+	for i, p := range points {
+		if found, err := pointExists(exists, timeless, p, p.Session); err != nil {
+			return nil, err
+		} else if found {
+			continue
+		}
+		if _, err := insert.Exec(p.Lat, p.Lon, p.Alt, p.Speed, p.Time, p.Bearing, p.Hdop, p.Acc, p.User, p.Session); err != nil {
+			return nil, err
+		}
+		inserted[i] = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+func (s *sqlStore) PointExists(p Point, anySession bool) (bool, error) {
+	session := p.Session
+	if anySession {
+		session = ""
+	}
+	return pointExists(s.stmtPointExists, s.stmtTimelessExists, p, session)
+}
+
+// pointExists looks for a duplicate of p in session, in any session when it
+// is empty.
+func pointExists(exists, timeless *timedStmt, p Point, session string) (bool, error) {
+	var row *sql.Row
+	if p.Time != 0 {
+		row = exists.QueryRow(p.User, session, session, p.Time)
+	} else {
+		row = timeless.QueryRow(p.User, session, session, p.Lat, p.Lon, p.Alt, p.Speed, p.Bearing, p.Hdop, p.Acc)
+	}
+	var one int
+	err := row.Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) LastPosition(user, session string) (*Point, error) {
+	var row *sql.Row
+	if session != "0" {
+		row = s.stmtWithUserAndSession.QueryRow(user, session)
+	} else {
+		row = s.stmtWithUserOnly.QueryRow(user)
+	}
+
+	p, err := scanPoint(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *sqlStore) LastPositions(session string) ([]Point, error) {
+	var rows *sql.Rows
+	var err error
+	if session != "0" {
+		rows, err = s.stmtLastPositionsBySes.Query(session)
+	} else {
+		rows, err = s.stmtLastPositions.Query()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanPoints(rows)
+}
+
+func (s *sqlStore) Sessions(user string) ([]string, error) {
+	rows, err := s.stmtGetUserSessions.Query(user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var session string
+		if err := rows.Scan(&session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqlStore) MaxSession(user string) (int64, error) {
+	var max int64
+	err := s.stmtMaxSession.QueryRow(user).Scan(&max)
+	return max, err
+}
+
+func (s *sqlStore) FetchPoints(q PointQuery) ([]Point, error) {
+	var conditions []string
+	var args []interface{}
+	if q.User != "" {
+		conditions = append(conditions, "{user} = ?")
+		args = append(args, q.User)
+		if q.Session != "" {
+			conditions = append(conditions, "{session} = ?")
+			args = append(args, q.Session)
+		}
+	}
+	if q.From != 0 {
+		conditions = append(conditions, "TIME >= ?")
+		args = append(args, q.From)
+	}
+	if q.Until != 0 {
+		conditions = append(conditions, "TIME <= ?")
+		args = append(args, q.Until)
+	}
+
+	var whereClause, limitClause string
+	if len(conditions) > 0 {
+		whereClause = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if q.Limit > 0 {
+		limitClause = " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	query := fmt.Sprintf("SELECT ID, %s FROM Points%s ORDER BY TIME DESC, ID DESC%s", pointColumns, whereClause, limitClause)
+	rows, err := s.db.Query(s.dialect.query(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	points, err := scanPoints(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Invert the points so they are returned oldest first
+	reversePoints(points)
+	return points, nil
+}
+
+func (s *sqlStore) FetchTrack(user, session string) ([]Point, error) {
+	rows, err := s.stmtFetchTrack.Query(user, session)
+	if err != nil {
+		return nil, err
+	}
+	return scanPoints(rows)
+}
+
+func (s *sqlStore) DeleteAll() error {
+	_, err := s.db.Exec("DELETE FROM Points")
+	return err
+}
+
+func (s *sqlStore) MovePoints(ids []int, session string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	move := s.stmtMovePoint.in(tx)
+	for _, id := range ids {
+		if _, err := move.Exec(session, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeleteSession(user, session string) error {
+	_, err := s.stmtDeleteSession.Exec(user, session)
+	return err
+}
+
+func (s *sqlStore) DeletePointsBefore(user string, before int64) (int64, error) {
+	res, err := s.stmtDeleteBefore.Exec(user, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) DownsamplePoints(user string, before, interval int64) (int64, error) {
+	res, err := s.stmtDownsample.Exec(user, before, user, before, interval)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) Vacuum(rewrite bool) error {
+	return s.dialect.vacuum(s.db, rewrite)
+}
+
+func (s *sqlStore) AddDevice(d Device) (int64, error) {
+	return s.insert(s.stmtAddDevice, d.User, d.Name, d.TokenHash, d.CreatedAt)
+}
+
+func (s *sqlStore) DeviceByTokenHash(hash string) (*Device, error) {
+	return scanDevice(s.stmtDeviceByToken.QueryRow(hash))
+}
+
+func (s *sqlStore) DeviceByName(name string) (*Device, error) {
+	return scanDevice(s.stmtDeviceByName.QueryRow(name))
+}
+
+func (s *sqlStore) HasDevices(user string) (bool, error) {
+	var one int
+	err := s.stmtHasDevices.QueryRow(user).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) Devices() ([]Device, error) {
+	rows, err := s.stmtDevices.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanDevices(rows)
+}
+
+func (s *sqlStore) RevokeDevice(id int64, at int64) (bool, error) {
+	return affected(s.stmtRevokeDevice, at, id)
+}
+
+func (s *sqlStore) AddShare(sh Share) (int64, error) {
+	return s.insert(s.stmtAddShare, sh.User, sh.Session, sh.LiveOnly, sh.From, sh.Until, sh.TokenHash, sh.CreatedAt, sh.ExpiresAt)
+}
+
+func (s *sqlStore) ShareByTokenHash(hash string) (*Share, error) {
+	sh, err := scanShare(s.stmtShareByToken.QueryRow(hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sh, nil
+}
+
+func (s *sqlStore) Shares(now int64) ([]Share, error) {
+	rows, err := s.stmtShares.Query(now)
+	if err != nil {
+		return nil, err
+	}
+	return scanShares(rows)
+}
+
+func (s *sqlStore) RevokeShare(id int64, at int64) (bool, error) {
+	return affected(s.stmtRevokeShare, at, id)
+}
+
+func (s *sqlStore) AddGeofence(g Geofence) (int64, error) {
+	return s.insert(s.stmtAddGeofence, g.User, g.Name, g.Type, g.Lat, g.Lon, g.Radius, polygonJSON(g), g.CreatedAt)
+}
+
+func (s *sqlStore) AddGeofenceEvent(e GeofenceEvent) (int64, error) {
+	return s.insert(s.stmtAddGeofenceEvent, e.GeofenceID, e.Geofence, e.User, e.Session, e.Type, e.Lat, e.Lon, e.Time)
+}
+
+func (s *sqlStore) GeofenceEvents(user string, limit int) ([]GeofenceEvent, error) {
+	rows, err := s.stmtGeofenceEvents.Query(user, user, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanGeofenceEvents(rows)
+}
+
+func (s *sqlStore) Geofences() ([]Geofence, error) {
+	rows, err := s.stmtGeofences.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanGeofences(rows)
+}
+
+func (s *sqlStore) UpdateGeofence(g Geofence) (bool, error) {
+	return affected(s.stmtUpdateGeofence, g.User, g.Name, g.Type, g.Lat, g.Lon, g.Radius, polygonJSON(g), g.ID)
+}
+
+func (s *sqlStore) DeleteGeofence(id int64) (bool, error) {
+	return affected(s.stmtDeleteGeofence, id)
+}
+
+func (s *sqlStore) LastGeofenceEvent(geofenceID int64, user string) (string, error) {
+	var eventType string
+	err := s.stmtLastGeofenceEvent.QueryRow(geofenceID, user).Scan(&eventType)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return eventType, err
+}
+
+func (s *sqlStore) AddWebhookDelivery(d WebhookDelivery) (int64, error) {
+	return s.insert(s.stmtAddWebhook, d.Webhook, d.Event, string(d.Body), d.Attempts, d.NextAttempt, d.CreatedAt)
+}
+
+func (s *sqlStore) DueWebhookDeliveries(webhook string, now int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.stmtDueWebhooks.Query(webhook, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (s *sqlStore) RescheduleWebhookDelivery(id int64, attempts int, next int64) error {
+	_, err := s.stmtRescheduleWebhook.Exec(attempts, next, id)
+	return err
+}
+
+func (s *sqlStore) DeleteWebhookDelivery(id int64) error {
+	_, err := s.stmtDeleteWebhook.Exec(id)
+	return err
+}
+
+func (s *sqlStore) QueuedWebhooks() ([]string, error) {
+	rows, err := s.stmtQueuedWebhooks.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *sqlStore) DeleteWebhookDeliveries(webhook string) (int64, error) {
+	res, err := s.stmtDeleteWebhookQueue.Exec(webhook)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Close closes the prepared statements and the database.
+func (s *sqlStore) Close() error {
+	for _, stmt := range []*timedStmt{
+		s.stmtWithUserAndSession,
+		s.stmtWithUserOnly,
+		s.stmtGetUserSessions,
+		s.stmtInsertPoint,
+		s.stmtFetchTrack,
+		s.stmtLastPositions,
+		s.stmtLastPositionsBySes,
+		s.stmtPointExists,
+		s.stmtTimelessExists,
+		s.stmtMaxSession,
+		s.stmtDeleteSession,
+		s.stmtMovePoint,
+		s.stmtDeleteBefore,
+		s.stmtDownsample,
+		s.stmtAddDevice,
+		s.stmtDeviceByToken,
+		s.stmtDeviceByName,
+		s.stmtHasDevices,
+		s.stmtDevices,
+		s.stmtRevokeDevice,
+		s.stmtAddShare,
+		s.stmtShareByToken,
+		s.stmtShares,
+		s.stmtRevokeShare,
+		s.stmtGeofences,
+		s.stmtAddGeofence,
+		s.stmtUpdateGeofence,
+		s.stmtDeleteGeofence,
+		s.stmtAddGeofenceEvent,
+		s.stmtLastGeofenceEvent,
+		s.stmtGeofenceEvents,
+		s.stmtAddWebhook,
+		s.stmtDueWebhooks,
+		s.stmtRescheduleWebhook,
+		s.stmtDeleteWebhook,
+		s.stmtQueuedWebhooks,
+		s.stmtDeleteWebhookQueue,
+	} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteIncrementalVacuum is the value of PRAGMA auto_vacuum in incremental
+// mode.
+const sqliteIncrementalVacuum = 2
+
+// sqliteDialect is the SQL of the SQLite store, which keeps the points in a
+// local database file.
+var sqliteDialect = &dialect{
+	driver: "sqlite3",
+	names: strings.NewReplacer(
+		"{user}", "USER",
+		"{session}", "SESSION",
+		"{GeofenceEvents}", "GeofenceEvents",
+		"{WebhookDeliveries}", "WebhookDeliveries",
+	),
+	maxSession:    "SELECT COALESCE(MAX(CAST({session} AS INTEGER)), 0) FROM Points WHERE {user} = ?",
+	migrations:    sqliteMigrations,
+	insertVersion: "INSERT INTO schema_version(VERSION, NAME, APPLIED_AT) VALUES(?, ?, ?)",
+	vacuum:        sqliteVacuum,
+}
+
+// OpenSQLiteStore opens the database file, creating it if needed, and
+// applies the pending migrations. New files are created in incremental
+// auto-vacuum mode, older ones keep their mode until sqliteVacuum rewrites
+// them.
+func OpenSQLiteStore(path string) (Store, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return openSQLStore(sqliteDialect, path+sep+"_auto_vacuum=incremental")
+}
+
+// sqliteVacuum frees the pages of the deleted rows with an incremental
+// vacuum. Databases created without incremental auto-vacuum are switched to
+// it first when rewrite is set, which rewrites the whole file once and blocks
+// the other queries meanwhile; otherwise they keep their free pages for the
+// next points.
+func sqliteVacuum(db *sql.DB, rewrite bool) error {
+	ctx := context.Background()
+	// The pragmas and VACUUM must run on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mode int
+	if err := conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode != sqliteIncrementalVacuum {
+		if !rewrite {
+			return nil
+		}
+		slog.Info("Switching the database to incremental vacuum, rewriting the file")
+		if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+			return err
+		}
+	}
+	// The pragma frees one page per step, so it is read to the end
+	rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// postgresTestDSN names the environment variable of the PostgreSQL database
+// the store tests also run against, for example the one of the docker
+// command of the README. Its tables are emptied first.
+const postgresTestDSN = "GLT_TEST_POSTGRES_DSN"
+
+// storeBackends returns a function opening an empty store for each backend
+// available to the tests.
+func storeBackends(t *testing.T) map[string]func(t *testing.T) Store {
+	backends := map[string]func(t *testing.T) Store{
+		databaseSQLite: func(t *testing.T) Store {
+			s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	if dsn := os.Getenv(postgresTestDSN); dsn != "" {
+		backends[databasePostgres] = func(t *testing.T) Store {
+			s, err := OpenPostgresStore(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := sql.Open("postgres", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.Exec("TRUNCATE points, devices, shares, geofences, geofence_events, webhook_deliveries RESTART IDENTITY"); err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+	} else {
+		t.Logf("%s not set, skipping PostgreSQL", postgresTestDSN)
+	}
+	return backends
+}
+
+// useTestStore makes an empty SQLite store the store of the server for the
+// duration of a test.
+func useTestStore(t *testing.T) Store {
+	s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := store
+	store = s
+	t.Cleanup(func() {
+		store = previous
+		s.Close()
+	})
+	return s
+}
+
+// forEachStore runs a check against an empty store of every backend.
+func forEachStore(t *testing.T, check func(t *testing.T, s Store)) {
+	for name, open := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			check(t, s)
+		})
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pointTimes(points []Point) []int64 {
+	times := make([]int64, len(points))
+	for i, p := range points {
+		times[i] = p.Time
+	}
+	return times
+}
+
+func TestStorePoints(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for i, p := range []Point{
+			{Lat: 45, Lon: 10, Time: 1000, User: "1", Session: "1"},
+			{Lat: 45.1, Lon: 10.1, Alt: 120, Speed: 3, Time: 2000, Bearing: 90, Hdop: 1.5, Acc: 4, User: "1", Session: "1"},
+			{Lat: 46, Lon: 11, Time: 3000, User: "1", Session: "2"},
+			{Lat: 47, Lon: 12, Time: 1500, User: "2", Session: "1"},
+		} {
+			if err := s.InsertPoint(p); err != nil {
+				t.Fatalf("point %d: %v", i, err)
+			}
+		}
+
+		last, err := s.LastPosition("1", "1")
+		must(t, err)
+		want := Point{ID: last.ID, Lat: 45.1, Lon: 10.1, Alt: 120, Speed: 3, Time: 2000, Bearing: 90, Hdop: 1.5, Acc: 4, User: "1", Session: "1"}
+		if *last != want {
+			t.Errorf("LastPosition(1, 1) = %+v, want %+v", *last, want)
+		}
+		if last, err = s.LastPosition("1", "0"); err != nil || last.Session != "2" {
+			t.Errorf("LastPosition(1, 0) = %+v, %v, want session 2", last, err)
+		}
+		if last, err = s.LastPosition("3", "0"); err != nil || last != nil {
+			t.Errorf("LastPosition(3, 0) = %+v, %v, want nil", last, err)
+		}
+
+		positions, err := s.LastPositions("0")
+		must(t, err)
+		if len(positions) != 2 || positions[0].Time != 3000 || positions[1].Time != 1500 {
+			t.Errorf("LastPositions(0) = %+v", positions)
+		}
+		if positions, err = s.LastPositions("1"); err != nil || len(positions) != 2 || positions[0].Time != 2000 {
+			t.Errorf("LastPositions(1) = %+v, %v", positions, err)
+		}
+
+		sessions, err := s.Sessions("1")
+		must(t, err)
+		if len(sessions) != 2 {
+			t.Errorf("Sessions(1) = %v", sessions)
+		}
+		if max, err := s.MaxSession("1"); err != nil || max != 2 {
+			t.Errorf("MaxSession(1) = %d, %v, want 2", max, err)
+		}
+
+		points, err := s.FetchPoints(PointQuery{User: "1"})
+		must(t, err)
+		if got := pointTimes(points); !reflect.DeepEqual(got, []int64{1000, 2000, 3000}) {
+			t.Errorf("FetchPoints(user 1) times = %v", got)
+		}
+		points, err = s.FetchPoints(PointQuery{Limit: 2})
+		must(t, err)
+		if got := pointTimes(points); !reflect.DeepEqual(got, []int64{2000, 3000}) {
+			t.Errorf("FetchPoints(limit 2) times = %v", got)
+		}
+		points, err = s.FetchPoints(PointQuery{User: "1", Session: "1", From: 1500, Until: 2500})
+		must(t, err)
+		if got := pointTimes(points); !reflect.DeepEqual(got, []int64{2000}) {
+			t.Errorf("FetchPoints(from, until) times = %v", got)
+		}
+
+		track, err := s.FetchTrack("1", "1")
+		must(t, err)
+		must(t, s.MovePoints([]int{track[1].ID}, "5"))
+		if max, err := s.MaxSession("1"); err != nil || max != 5 {
+			t.Errorf("MaxSession after MovePoints = %d, %v, want 5", max, err)
+		}
+
+		must(t, s.DeleteSession("1", "5"))
+		if points, _ = s.FetchPoints(PointQuery{User: "1"}); len(points) != 2 {
+			t.Errorf("%d points left after DeleteSession, want 2", len(points))
+		}
+		must(t, s.DeleteAll())
+		if points, _ = s.FetchPoints(PointQuery{}); len(points) != 0 {
+			t.Errorf("%d points left after DeleteAll", len(points))
+		}
+	})
+}
+
+func TestStoreInsertPoints(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		batch := []Point{
+			{Lat: 45, Lon: 10, Time: 1000, User: "1", Session: "1"},
+			{Lat: 45, Lon: 10, Time: 2000, User: "1", Session: "1"},
+		}
+		inserted, err := s.InsertPoints(batch)
+		must(t, err)
+		if !reflect.DeepEqual(inserted, []bool{true, true}) {
+			t.Errorf("first InsertPoints = %v", inserted)
+		}
+
+		// A retried batch is skipped, except its new points. Points without
+		// timestamp are compared by their values.
+		batch = append(batch,
+			Point{Lat: 45, Lon: 10, Time: 3000, User: "1", Session: "1"},
+			Point{Lat: 46, Lon: 11, Speed: 2, User: "1", Session: "1"},
+			Point{Lat: 46, Lon: 11, Speed: 2, User: "1", Session: "1"},
+			Point{Lat: 46, Lon: 11, Speed: 3, User: "1", Session: "1"},
+		)
+		inserted, err = s.InsertPoints(batch)
+		must(t, err)
+		if !reflect.DeepEqual(inserted, []bool{false, false, true, true, false, true}) {
+			t.Errorf("retried InsertPoints = %v", inserted)
+		}
+
+		moved := Point{Lat: 45, Lon: 10, Time: 1000, User: "1", Session: "0"}
+		if found, err := s.PointExists(moved, false); err != nil || found {
+			t.Errorf("PointExists(session 0) = %v, %v", found, err)
+		}
+		if found, err := s.PointExists(moved, true); err != nil || !found {
+			t.Errorf("PointExists(any session) = %v, %v", found, err)
+		}
+		moved.User = "2"
+		if found, err := s.PointExists(moved, true); err != nil || found {
+			t.Errorf("PointExists(other user) = %v, %v", found, err)
+		}
+	})
+}
+
+func TestStoreRetention(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for _, ms := range []int64{1000, 1500, 2500, 3000, 9000} {
+			must(t, s.InsertPoint(Point{Lat: 45, Lon: 10, Time: ms, User: "1", Session: "1"}))
+		}
+		must(t, s.InsertPoint(Point{Lat: 45, Lon: 10, User: "1", Session: "1"}))
+
+		// One point per second before 5000: 1000, 2500 and 3000 are kept
+		n, err := s.DownsamplePoints("1", 5000, 1000)
+		must(t, err)
+		if n != 1 {
+			t.Errorf("DownsamplePoints removed %d points, want 1", n)
+		}
+		n, err = s.DeletePointsBefore("1", 2600)
+		must(t, err)
+		if n != 2 {
+			t.Errorf("DeletePointsBefore removed %d points, want 2", n)
+		}
+		points, err := s.FetchTrack("1", "1")
+		must(t, err)
+		if got := pointTimes(points); !reflect.DeepEqual(got, []int64{3000, 9000, 0}) {
+			t.Errorf("points left = %v", got)
+		}
+		must(t, s.Vacuum(true))
+	})
+}
+
+func TestStoreDevicesAndShares(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		id, err := s.AddDevice(Device{User: "1", Name: "phone", TokenHash: "hash1", CreatedAt: 10})
+		must(t, err)
+		d, err := s.DeviceByTokenHash("hash1")
+		must(t, err)
+		if d == nil || d.ID != id || d.User != "1" || d.Name != "phone" {
+			t.Errorf("DeviceByTokenHash = %+v", d)
+		}
+		if ok, err := s.RevokeDevice(id, 20); err != nil || !ok {
+			t.Errorf("RevokeDevice = %v, %v", ok, err)
+		}
+		if d, err = s.DeviceByTokenHash("hash1"); err != nil || d != nil {
+			t.Errorf("revoked DeviceByTokenHash = %+v, %v", d, err)
+		}
+		if devices, err := s.Devices(); err != nil || len(devices) != 1 || devices[0].RevokedAt != 20 {
+			t.Errorf("Devices = %+v, %v", devices, err)
+		}
+
+		share := Share{User: "1", Session: "2", LiveOnly: true, From: 5, Until: 6, TokenHash: "share1", CreatedAt: 10, ExpiresAt: 100}
+		share.ID, err = s.AddShare(share)
+		must(t, err)
+		got, err := s.ShareByTokenHash("share1")
+		must(t, err)
+		if got == nil || *got != share {
+			t.Errorf("ShareByTokenHash = %+v, want %+v", got, share)
+		}
+		if shares, err := s.Shares(50); err != nil || len(shares) != 1 {
+			t.Errorf("Shares(50) = %+v, %v", shares, err)
+		}
+		if shares, err := s.Shares(100); err != nil || len(shares) != 0 {
+			t.Errorf("Shares(100) = %+v, %v, the share expired", shares, err)
+		}
+		if ok, err := s.RevokeShare(share.ID, 20); err != nil || !ok {
+			t.Errorf("RevokeShare = %v, %v", ok, err)
+		}
+		if ok, err := s.RevokeShare(share.ID, 30); err != nil || ok {
+			t.Errorf("second RevokeShare = %v, %v", ok, err)
+		}
+	})
+}
+
+func TestStoreGeofences(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		g := Geofence{User: "1", Name: "site", Type: geofencePolygon, Polygon: [][2]float64{{45, 10}, {45, 11}, {46, 11}}, CreatedAt: 10}
+		id, err := s.AddGeofence(g)
+		must(t, err)
+		g.ID, g.Name = id, "site 2"
+		if ok, err := s.UpdateGeofence(g); err != nil || !ok {
+			t.Errorf("UpdateGeofence = %v, %v", ok, err)
+		}
+		list, err := s.Geofences()
+		must(t, err)
+		if len(list) != 1 || !reflect.DeepEqual(list[0], g) {
+			t.Errorf("Geofences = %+v, want %+v", list, g)
+		}
+
+		for _, typ := range []string{geofenceEnter, geofenceExit} {
+			_, err := s.AddGeofenceEvent(GeofenceEvent{GeofenceID: id, Geofence: g.Name, User: "1", Session: "1", Type: typ, Lat: 45, Lon: 10, Time: 10})
+			must(t, err)
+		}
+		if typ, err := s.LastGeofenceEvent(id, "1"); err != nil || typ != geofenceExit {
+			t.Errorf("LastGeofenceEvent = %q, %v", typ, err)
+		}
+		if typ, err := s.LastGeofenceEvent(id, "2"); err != nil || typ != "" {
+			t.Errorf("LastGeofenceEvent of another user = %q, %v", typ, err)
+		}
+		if events, err := s.GeofenceEvents("", 1); err != nil || len(events) != 1 || events[0].Type != geofenceExit {
+			t.Errorf("GeofenceEvents = %+v, %v", events, err)
+		}
+		if events, err := s.GeofenceEvents("2", 10); err != nil || len(events) != 0 {
+			t.Errorf("GeofenceEvents(2) = %+v, %v", events, err)
+		}
+
+		if ok, err := s.DeleteGeofence(id); err != nil || !ok {
+			t.Errorf("DeleteGeofence = %v, %v", ok, err)
+		}
+	})
+}
+
+func TestStoreWebhookQueue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		d := WebhookDelivery{Webhook: "dispatch", Event: webhookPoint, Body: []byte(`{"a":1}`), NextAttempt: 100, CreatedAt: 100}
+		id, err := s.AddWebhookDelivery(d)
+		must(t, err)
+		_, err = s.AddWebhookDelivery(WebhookDelivery{Webhook: "old", Event: webhookPoint, Body: []byte("{}"), NextAttempt: 100, CreatedAt: 100})
+		must(t, err)
+		if due, err := s.DueWebhookDeliveries("dispatch", 50, 10); err != nil || len(due) != 0 {
+			t.Errorf("DueWebhookDeliveries(50) = %+v, %v", due, err)
+		}
+		must(t, s.RescheduleWebhookDelivery(id, 1, 200))
+		due, err := s.DueWebhookDeliveries("dispatch", 200, 10)
+		must(t, err)
+		d.ID, d.Attempts, d.NextAttempt = id, 1, 200
+		if len(due) != 1 || !reflect.DeepEqual(due[0], d) {
+			t.Errorf("DueWebhookDeliveries(200) = %+v, want %+v", due, d)
+		}
+		must(t, s.DeleteWebhookDelivery(id))
+		if due, err = s.DueWebhookDeliveries("dispatch", 200, 10); err != nil || len(due) != 0 {
+			t.Errorf("DueWebhookDeliveries after delete = %+v, %v", due, err)
+		}
+
+		if names, err := s.QueuedWebhooks(); err != nil || !reflect.DeepEqual(names, []string{"old"}) {
+			t.Errorf("QueuedWebhooks = %v, %v", names, err)
+		}
+		if n, err := s.DeleteWebhookDeliveries("old"); err != nil || n != 1 {
+			t.Errorf("DeleteWebhookDeliveries = %d, %v", n, err)
+		}
+	})
+}
+
+func TestDialectQuery(t *testing.T) {
+	q := "SELECT ID FROM {GeofenceEvents} WHERE ? = '' OR {user} = ? LIMIT ?"
+	if got, want := postgresDialect.query(q), "SELECT ID FROM geofence_events WHERE $1 = '' OR user_id = $2 LIMIT $3"; got != want {
+		t.Errorf("postgres query = %q, want %q", got, want)
+	}
+	if got, want := sqliteDialect.query(q), "SELECT ID FROM GeofenceEvents WHERE ? = '' OR USER = ? LIMIT ?"; got != want {
+		t.Errorf("sqlite query = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files are checked for a
+// renewal.
+const certCheckInterval = 10 * time.Second
+
+// defaultACMECacheDir is used when ACMECacheDir is not set.
+const defaultACMECacheDir = "acme-cache"
+
+// newTLSConfig returns the TLS configuration of the HTTPS listener. With
+// ACMEDomains the certificates are obtained and renewed over ACME, and the
+// returned function wraps the handler of the HTTP listener to answer the
+// http-01 challenges. Otherwise the certificate files are reloaded when they
+// change and the function is nil.
+func newTLSConfig(cfg Cfg) (*tls.Config, func(http.Handler) http.Handler, error) {
+	if len(cfg.ACMEDomains) == 0 {
+		certs, err := newCertReloader(cfg.CertPathCrt, cfg.CertPathKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: certs.getCertificate}, nil, nil
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	if cfg.ACMECAFile != "" {
+		pem, err := os.ReadFile(cfg.ACMECAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ACMECAFile: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("ACMECAFile: no certificate found in %s", cfg.ACMECAFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+
+	cacheDir := cfg.ACMECacheDir
+	if cacheDir == "" {
+		cacheDir = defaultACMECacheDir
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Email:      cfg.ACMEEmail,
+		Client:     client,
+	}
+	return m.TLSConfig(), m.HTTPHandler, nil
+}
+
+// certReloader serves the certificate of CertPathCrt and CertPathKey and reads
+// it again when the files change, so a renewed certificate is used by the new
+// connections without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // of the files the certificate was read from
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the newest modification time of the two files.
+func (r *certReloader) modified() (time.Time, error) {
+	var newest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// getCertificate is the GetCertificate of the HTTPS listener. The files are
+// checked at most every certCheckInterval. A certificate that cannot be read,
+// like one whose key is not written yet, is tried again at the next check
+// while the current one is still served.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if modTime, err := r.modified(); err == nil && !modTime.Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				slog.Error("Cannot reload the certificate, keeping the current one", "error", err)
+			} else {
+				slog.Info("Certificate reloaded", "file", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
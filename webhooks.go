@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook event types
+const (
+	webhookPoint         = "point"
+	webhookSessionStart  = "session_start"
+	webhookSessionEnd    = "session_end"
+	webhookGeofenceEnter = "geofence_enter"
+	webhookGeofenceExit  = "geofence_exit"
+)
+
+const (
+	// webhookPollInterval is how often the queue is checked for retries.
+	webhookPollInterval = 5 * time.Second
+	// webhookBatch is the number of due deliveries read at once.
+	webhookBatch = 50
+	// webhookFirstRetry is the delay before the first retry, doubled at
+	// every failed attempt up to webhookMaxRetryDelay.
+	webhookFirstRetry    = 10 * time.Second
+	webhookMaxRetryDelay = time.Hour
+	// defaultWebhookMaxAttempts is used when WebhookMaxAttempts is not set.
+	defaultWebhookMaxAttempts = 10
+	// defaultWebhookSessionTimeout is used when WebhookSessionTimeout is not set.
+	defaultWebhookSessionTimeout = 30 * time.Minute
+)
+
+var webhookEvents = []string{webhookPoint, webhookSessionStart, webhookSessionEnd, webhookGeofenceEnter, webhookGeofenceExit}
+
+// Webhook is a subscription from config.yaml. The JSON body of every matching
+// event is posted to URL, signed with Secret when one is set.
+type Webhook struct {
+	Name   string   `yaml:"Name"` // identifies the queued deliveries, the URL when empty
+	URL    string   `yaml:"URL"`
+	Events []string `yaml:"Events"` // empty for every event type
+	Users  []string `yaml:"Users"`  // empty for every user
+	Secret string   `yaml:"Secret"`
+}
+
+// wants reports whether the webhook subscribes to an event of a user.
+func (h *Webhook) wants(event, user string) bool {
+	return (len(h.Events) == 0 || slices.Contains(h.Events, event)) && (len(h.Users) == 0 || slices.Contains(h.Users, user))
+}
+
+// WebhookDelivery is a queued POST of an event to a webhook. It stays in the
+// database until the receiver accepts it or the attempts run out, so
+// deliveries survive a restart and an outage of the receiver.
+type WebhookDelivery struct {
+	ID          int64
+	Webhook     string // name of the webhook
+	Event       string
+	Body        []byte
+	Attempts    int
+	NextAttempt int64 // Unix milliseconds
+	CreatedAt   int64 // Unix milliseconds
+}
+
+// webhookPayload is the body posted to the webhooks.
+type webhookPayload struct {
+	Event string `json:"event"`
+	Time  int64  `json:"timestamp"` // Unix milliseconds
+	Data  any    `json:"data"`
+}
+
+// webhookSession is the data of session_start and session_end events.
+type webhookSession struct {
+	User    string `json:"user"`
+	Session string `json:"session"`
+}
+
+// trackedSession is the session a user last sent points to.
+type trackedSession struct {
+	session  string
+	lastSeen time.Time
+	ended    bool
+}
+
+// webhookDispatcher queues the events for the matching webhooks and delivers
+// them in the background, each webhook on its own so a receiver that is down
+// does not delay the others. A session starts with its first point and ends
+// when its user switches to another session or sends nothing for
+// sessionTimeout.
+type webhookDispatcher struct {
+	client         *http.Client
+	hooks          []Webhook
+	wake           []chan struct{} // of each webhook
+	maxAttempts    int
+	sessionTimeout time.Duration
+	quit           chan struct{}
+	stopped        chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*trackedSession // by user
+}
+
+var webhooks = &webhookDispatcher{}
+
+// newWebhookDispatcher checks the webhooks of the configuration.
+func newWebhookDispatcher(cfg Cfg, client *http.Client) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		client:         client,
+		maxAttempts:    cfg.WebhookMaxAttempts,
+		sessionTimeout: defaultWebhookSessionTimeout,
+		quit:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+		sessions:       make(map[string]*trackedSession),
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = defaultWebhookMaxAttempts
+	}
+	if cfg.WebhookSessionTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.WebhookSessionTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("WebhookSessionTimeout: %w", err)
+		}
+		d.sessionTimeout = timeout
+	}
+
+	names := make(map[string]bool)
+	for _, h := range cfg.Webhooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("webhook %q has no URL", h.Name)
+		}
+		if h.Name == "" {
+			h.Name = h.URL
+		}
+		if names[h.Name] {
+			return nil, fmt.Errorf("webhook %q is defined twice", h.Name)
+		}
+		names[h.Name] = true
+		for _, event := range h.Events {
+			if !slices.Contains(webhookEvents, event) {
+				return nil, fmt.Errorf("webhook %q: unknown event %q", h.Name, event)
+			}
+		}
+		d.hooks = append(d.hooks, h)
+		d.wake = append(d.wake, make(chan struct{}, 1))
+	}
+	return d, nil
+}
+
+func (d *webhookDispatcher) enabled() bool {
+	return len(d.hooks) > 0
+}
+
+// run delivers the queued events, and ends the idle sessions, until stop is
+// called. The deliveries of the webhooks removed from the configuration are
+// dropped.
+func (d *webhookDispatcher) run() {
+	defer close(d.stopped)
+	d.dropRemoved()
+
+	var workers sync.WaitGroup
+	for i := range d.hooks {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			d.deliver(&d.hooks[i], d.wake[i])
+		}()
+	}
+	defer workers.Wait()
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		d.endIdleSessions(time.Now())
+		select {
+		case <-ticker.C:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// deliver posts the deliveries of a webhook when they are due until stop is
+// called.
+func (d *webhookDispatcher) deliver(hook *Webhook, wake <-chan struct{}) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		d.deliverDue(hook)
+		select {
+		case <-ticker.C:
+		case <-wake:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// dropRemoved removes the deliveries of the webhooks no longer configured.
+func (d *webhookDispatcher) dropRemoved() {
+	names, err := store.QueuedWebhooks()
+	if err != nil {
+		slog.Error("Webhook queue error", "error", err)
+		return
+	}
+	for _, name := range names {
+		if slices.ContainsFunc(d.hooks, func(h Webhook) bool { return h.Name == name }) {
+			continue
+		}
+		n, err := store.DeleteWebhookDeliveries(name)
+		if err != nil {
+			slog.Error("Webhook queue error", "error", err)
+			continue
+		}
+		slog.Info("Dropped the deliveries of a removed webhook", "webhook", name, "deliveries", n)
+	}
+}
+
+// stop waits for the deliveries in progress and ends run. The deliveries not
+// attempted yet stay queued for the next start.
+func (d *webhookDispatcher) stop() {
+	if !d.enabled() {
+		return
+	}
+	close(d.quit)
+	<-d.stopped
+}
+
+// stopping reports whether stop was called.
+func (d *webhookDispatcher) stopping() bool {
+	select {
+	case <-d.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// pointStored queues the events caused by a point received live.
+func (d *webhookDispatcher) pointStored(p Point, transitions []GeofenceEvent) {
+	if !d.enabled() {
+		return
+	}
+
+	d.trackSession(p)
+	d.enqueue(webhookPoint, p.User, p.LatLng())
+	for i := range transitions {
+		event := webhookGeofenceExit
+		if transitions[i].Type == geofenceEnter {
+			event = webhookGeofenceEnter
+		}
+		d.enqueue(event, transitions[i].User, &transitions[i])
+	}
+}
+
+// trackSession queues the session events of a point. The store is called
+// without holding mu.
+func (d *webhookDispatcher) trackSession(p Point) {
+	d.mu.Lock()
+	now := time.Now()
+	current, ok := d.sessions[p.User]
+	same := ok && current.session == p.Session
+	// The session resumed after it timed out
+	resumed := same && current.ended
+	var ended *webhookSession
+	if ok && !same && !current.ended {
+		ended = &webhookSession{p.User, current.session}
+	}
+	if same {
+		current.lastSeen, current.ended = now, false
+	} else {
+		d.sessions[p.User] = &trackedSession{session: p.Session, lastSeen: now}
+	}
+	d.mu.Unlock()
+
+	if ended != nil {
+		d.enqueue(webhookSessionEnd, p.User, *ended)
+	}
+	if resumed {
+		d.enqueue(webhookSessionStart, p.User, webhookSession{p.User, p.Session})
+	}
+	if same {
+		return
+	}
+
+	// Only the first point starts a session, which is not the case of a
+	// session already running when the server was restarted.
+	points, err := store.FetchPoints(PointQuery{User: p.User, Session: p.Session, Limit: 2})
+	if err != nil {
+		slog.Error("Webhook session query error", "user", p.User, "session", p.Session, "error", err)
+		return
+	}
+	if len(points) <= 1 {
+		d.enqueue(webhookSessionStart, p.User, webhookSession{p.User, p.Session})
+	}
+}
+
+// endIdleSessions queues the end of the sessions without recent points.
+func (d *webhookDispatcher) endIdleSessions(now time.Time) {
+	if !d.enabled() || d.sessionTimeout <= 0 {
+		return
+	}
+
+	var ended []webhookSession
+	d.mu.Lock()
+	for user, s := range d.sessions {
+		if !s.ended && now.Sub(s.lastSeen) >= d.sessionTimeout {
+			s.ended = true
+			ended = append(ended, webhookSession{user, s.session})
+		}
+	}
+	d.mu.Unlock()
+
+	for _, s := range ended {
+		d.enqueue(webhookSessionEnd, s.User, s)
+	}
+}
+
+// enqueue stores a delivery of the event for every webhook subscribed to it.
+func (d *webhookDispatcher) enqueue(event, user string, data any) {
+	now := time.Now().UnixMilli()
+	var body []byte
+	for i, h := range d.hooks {
+		if !h.wants(event, user) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(webhookPayload{Event: event, Time: now, Data: data})
+			if err != nil {
+				slog.Error("Error marshaling JSON", "error", err)
+				return
+			}
+		}
+		delivery := WebhookDelivery{Webhook: h.Name, Event: event, Body: body, NextAttempt: now, CreatedAt: now}
+		if _, err := store.AddWebhookDelivery(delivery); err != nil {
+			slog.Error("Webhook queue error", "error", err)
+			continue
+		}
+		select {
+		case d.wake[i] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliverDue posts the deliveries of a webhook whose attempt is due.
+func (d *webhookDispatcher) deliverDue(hook *Webhook) {
+	for {
+		due, err := store.DueWebhookDeliveries(hook.Name, time.Now().UnixMilli(), webhookBatch)
+		if err != nil {
+			slog.Error("Webhook queue error", "error", err)
+			return
+		}
+		for _, delivery := range due {
+			if d.stopping() {
+				return
+			}
+			d.attempt(hook, delivery)
+		}
+		if len(due) < webhookBatch {
+			return
+		}
+	}
+}
+
+// attempt posts a delivery, removing it from the queue when it is accepted
+// and scheduling the next attempt when it is not.
+func (d *webhookDispatcher) attempt(hook *Webhook, delivery WebhookDelivery) {
+	err := d.post(hook, delivery)
+	if err == nil {
+		d.remove(delivery)
+		return
+	}
+
+	attempts := delivery.Attempts + 1
+	if attempts >= d.maxAttempts {
+		slog.Warn("Webhook delivery dropped", "webhook", hook.Name, "event", delivery.Event, "delivery", delivery.ID, "attempts", attempts, "error", err)
+		d.remove(delivery)
+		return
+	}
+	next := time.Now().Add(webhookRetryDelay(attempts))
+	slog.Debug("Webhook delivery failed", "webhook", hook.Name, "event", delivery.Event, "delivery", delivery.ID, "retry_at", next.Format(time.RFC3339), "error", err)
+	if err := store.RescheduleWebhookDelivery(delivery.ID, attempts, next.UnixMilli()); err != nil {
+		slog.Error("Webhook queue error", "error", err)
+	}
+}
+
+// post sends a delivery. Receivers must answer with a 2xx status.
+func (d *webhookDispatcher) post(hook *Webhook, delivery WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoLiveTracking-Webhook")
+	req.Header.Set("X-GoLiveTracking-Event", delivery.Event)
+	req.Header.Set("X-GoLiveTracking-Delivery", strconv.FormatInt(delivery.ID, 10))
+	if hook.Secret != "" {
+		req.Header.Set("X-GoLiveTracking-Signature", "sha256="+webhookSignature(hook.Secret, delivery.Body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) remove(delivery WebhookDelivery) {
+	if err := store.DeleteWebhookDelivery(delivery.ID); err != nil {
+		slog.Error("Webhook queue error", "error", err)
+	}
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of a body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay returns the wait after a number of failed attempts.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookFirstRetry
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookMaxRetryDelay)
+}
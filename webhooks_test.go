@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a test receiver answering with the statuses of its
+// calls in turn, the last one for every further call.
+type webhookReceiver struct {
+	*httptest.Server
+	calls    atomic.Int32
+	received chan *http.Request
+	bodies   chan []byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rcv := &webhookReceiver{received: make(chan *http.Request, 10), bodies: make(chan []byte, 10)}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(rcv.calls.Add(1))
+		body, _ := io.ReadAll(r.Body)
+		rcv.received <- r
+		rcv.bodies <- body
+		w.WriteHeader(statuses[min(call, len(statuses))-1])
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func newTestDispatcher(t *testing.T, cfg Cfg) *webhookDispatcher {
+	d, err := newWebhookDispatcher(cfg, &http.Client{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// queued returns the deliveries of a webhook queued for any time.
+func queued(t *testing.T, webhook string) []WebhookDelivery {
+	due, err := store.DueWebhookDeliveries(webhook, 1<<62, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return due
+}
+
+func TestWebhookSignature(t *testing.T) {
+	useTestStore(t)
+	rcv := newWebhookReceiver(t, http.StatusOK)
+	d := newTestDispatcher(t, Cfg{Webhooks: []Webhook{{Name: "signed", URL: rcv.URL, Secret: "s3cret"}}})
+
+	d.enqueue(webhookSessionStart, "1", webhookSession{"1", "2"})
+	d.deliverDue(&d.hooks[0])
+
+	if rcv.calls.Load() != 1 {
+		t.Fatalf("receiver called %d times, want 1", rcv.calls.Load())
+	}
+	r, body := <-rcv.received, <-rcv.bodies
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if got, want := r.Header.Get("X-GoLiveTracking-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if got := r.Header.Get("X-GoLiveTracking-Event"); got != webhookSessionStart {
+		t.Errorf("event header = %q", got)
+	}
+	if left := queued(t, "signed"); len(left) != 0 {
+		t.Errorf("%d deliveries left after success", len(left))
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	useTestStore(t)
+	rcv := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusOK)
+	d := newTestDispatcher(t, Cfg{Webhooks: []Webhook{{Name: "flaky", URL: rcv.URL}}})
+
+	d.enqueue(webhookPoint, "1", Point{User: "1", Session: "1"})
+	before := time.Now().Truncate(time.Millisecond)
+	d.deliverDue(&d.hooks[0])
+	left := queued(t, "flaky")
+	if len(left) != 1 || left[0].Attempts != 1 {
+		t.Fatalf("queue after a failure = %+v, want one delivery with 1 attempt", left)
+	}
+	if next := time.UnixMilli(left[0].NextAttempt); next.Before(before.Add(webhookFirstRetry)) || next.After(time.Now().Add(webhookFirstRetry)) {
+		t.Errorf("next attempt in %v, want %v", next.Sub(before), webhookFirstRetry)
+	}
+
+	// Not due yet
+	d.deliverDue(&d.hooks[0])
+	if rcv.calls.Load() != 1 {
+		t.Fatalf("receiver called %d times before the retry was due", rcv.calls.Load())
+	}
+
+	must(t, store.RescheduleWebhookDelivery(left[0].ID, left[0].Attempts, 0))
+	d.deliverDue(&d.hooks[0])
+	if rcv.calls.Load() != 2 {
+		t.Fatalf("receiver called %d times, want 2", rcv.calls.Load())
+	}
+	first, retry := <-rcv.received, <-rcv.received
+	if a, b := first.Header.Get("X-GoLiveTracking-Delivery"), retry.Header.Get("X-GoLiveTracking-Delivery"); a == "" || a != b {
+		t.Errorf("delivery headers %q and %q, want the same id", a, b)
+	}
+	if left := queued(t, "flaky"); len(left) != 0 {
+		t.Errorf("%d deliveries left after the retry", len(left))
+	}
+}
+
+func TestWebhookDroppedAfterMaxAttempts(t *testing.T) {
+	useTestStore(t)
+	rcv := newWebhookReceiver(t, http.StatusInternalServerError)
+	d := newTestDispatcher(t, Cfg{WebhookMaxAttempts: 2, Webhooks: []Webhook{{Name: "down", URL: rcv.URL}}})
+
+	d.enqueue(webhookPoint, "1", Point{User: "1", Session: "1"})
+	d.deliverDue(&d.hooks[0])
+	left := queued(t, "down")
+	if len(left) != 1 {
+		t.Fatalf("%d deliveries queued after the first attempt, want 1", len(left))
+	}
+	must(t, store.RescheduleWebhookDelivery(left[0].ID, left[0].Attempts, 0))
+	d.deliverDue(&d.hooks[0])
+	if left := queued(t, "down"); len(left) != 0 {
+		t.Errorf("%d deliveries left after the last attempt", len(left))
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		5:  160 * time.Second,
+		9:  2560 * time.Second,
+		10: time.Hour,
+		50: time.Hour,
+	} {
+		if got := webhookRetryDelay(attempts); got != want {
+			t.Errorf("webhookRetryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookQueuePersisted(t *testing.T) {
+	useTestStore(t)
+	rcv := newWebhookReceiver(t, http.StatusOK)
+	cfg := Cfg{Webhooks: []Webhook{{Name: "kept", URL: rcv.URL}}}
+
+	// Queued by a previous run that stopped before delivering, with a
+	// webhook removed from the configuration since
+	newTestDispatcher(t, cfg).enqueue(webhookPoint, "1", Point{User: "1", Session: "1"})
+	_, err := store.AddWebhookDelivery(WebhookDelivery{Webhook: "removed", Event: webhookPoint, Body: []byte("{}")})
+	must(t, err)
+
+	d := newTestDispatcher(t, cfg)
+	go d.run()
+	select {
+	case <-rcv.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued delivery was not sent after the restart")
+	}
+	d.stop()
+
+	if left := queued(t, "kept"); len(left) != 0 {
+		t.Errorf("%d deliveries left", len(left))
+	}
+	if left := queued(t, "removed"); len(left) != 0 {
+		t.Errorf("%d deliveries of the removed webhook left", len(left))
+	}
+}
+
+func TestWebhookSlowReceiver(t *testing.T) {
+	useTestStore(t)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fast := newWebhookReceiver(t, http.StatusOK)
+	d := newTestDispatcher(t, Cfg{Webhooks: []Webhook{{Name: "slow", URL: slow.URL}, {Name: "fast", URL: fast.URL}}})
+
+	go d.run()
+	d.enqueue(webhookPoint, "1", Point{User: "1", Session: "1"})
+	select {
+	case <-fast.received:
+	case <-time.After(2 * time.Second):
+		t.Error("a slow receiver delayed the other webhook")
+	}
+	close(release)
+	d.stop()
+}